@@ -1,41 +1,85 @@
 package client
 
 import (
-    "time"
     "sync"
+    "errors"
+    "context"
     amqp "github.com/rabbitmq/amqp091-go"
     txLogger "github.com/serenity-77/bagudung/logger"
     txUtils "github.com/serenity-77/bagudung/utils"
 )
 
 
+var (
+    ErrClientClosed     = errors.New("amqp: client closed")
+    ErrClientFailed     = errors.New("amqp: client gave up reconnecting")
+)
+
 var _ IAmqpConnection   = (*amqpConnection)(nil)
 var _ IAmqpChannel      = (*amqp.Channel)(nil)
 
 type IAmqpConnection interface {
-    Channel()                       (IAmqpChannel, error)
-    Close()                         error
-    NotifyClose(chan *amqp.Error)   chan *amqp.Error
-    GetClock()                      txUtils.IClock
+    Channel()                           (IAmqpChannel, error)
+    Close()                             error
+    NotifyClose(chan *amqp.Error)       chan *amqp.Error
+    NotifyBlocked(chan amqp.Blocking)   chan amqp.Blocking
+    GetClock()                          txUtils.IClock
 }
 
 type IAmqpChannel interface {
     QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+    QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+    ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+    Confirm(noWait bool) error
+    NotifyPublish(chan amqp.Confirmation) chan amqp.Confirmation
+    NotifyClose(chan *amqp.Error) chan *amqp.Error
+    PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+    Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<- chan amqp.Delivery, error)
+    Qos(prefetchCount, prefetchSize int, global bool) error
+    Cancel(consumer string, noWait bool) error
+    Close() error
 }
 
 type AmqpClient struct {
     conn            IAmqpConnection
     mu              sync.Mutex
     dialUrl         string
+    endpoints       []string
+    selection       EndpointSelection
+    nextEndpoint    int
+    currentUrl      string
     dialConfig      *amqp.Config
     dialFunc        AmqpDialFunc
     logger          txLogger.ILogger
     disconnect      chan struct{}
     loopStopped     chan struct{}
+    closed          bool
+    closeErr        error
+    shutdownDone    chan struct{}
+    failed          bool
+    blocked         *BlockedError
+    failFastBlocked bool
+    reconnectPolicy ReconnectPolicy
+    topology        *Topology
+    connGen         uint64
+    connWaiters     []chan struct{}
+    publisher       *amqpPublisher
+    eventMu         sync.Mutex
+    eventReceivers  []*eventSubscriber
+    eventsClosed    bool
+    eventsDropped   uint64
 }
 
 type AmqpDialFunc   func(string, *amqp.Config) (IAmqpConnection, error)
 
+type AmqpClientOption func(*AmqpClient)
+
+func WithReconnectPolicy(policy ReconnectPolicy) AmqpClientOption {
+    return func(c *AmqpClient) {
+        c.reconnectPolicy = policy
+    }
+}
+
 type amqpConnection struct {
     *amqp.Connection
     clock   txUtils.IClock
@@ -57,31 +101,45 @@ func _defaultDialFunc(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection,
     if dialConfig == nil {
         conn, err = amqp.Dial(dialUrl)
     } else {
-        conn, err = amqp.DialConfig(dialUrl, *dialConfig)
+        config := *dialConfig
+        // DialConfig sets the ServerName of the tls config to the dialed
+        // host, which must not leak into the dials of other endpoints
+        if config.TLSClientConfig != nil {
+            config.TLSClientConfig = config.TLSClientConfig.Clone()
+        }
+        conn, err = amqp.DialConfig(dialUrl, config)
     }
 
     return &amqpConnection{conn, txUtils.NewRealClock()}, err
 }
 
-func NewAmqpClientDialFunc(dialUrl string, dialConfig *amqp.Config, dialFunc AmqpDialFunc, logger txLogger.ILogger) (*AmqpClient, error) {
+func NewAmqpClientDialFunc(dialUrl string, dialConfig *amqp.Config, dialFunc AmqpDialFunc, logger txLogger.ILogger, opts ...AmqpClientOption) (*AmqpClient, error) {
+    return NewAmqpClientDialFuncContext(context.Background(), dialUrl, dialConfig, dialFunc, logger, opts...)
+}
+
+// NewAmqpClientDialFuncContext gives up on the first connect when ctx is
+// done. A connection which is established after that is closed.
+func NewAmqpClientDialFuncContext(ctx context.Context, dialUrl string, dialConfig *amqp.Config, dialFunc AmqpDialFunc, logger txLogger.ILogger, opts ...AmqpClientOption) (*AmqpClient, error) {
     client := &AmqpClient{
-        dialUrl:        dialUrl,
-        dialConfig:     dialConfig,
-        dialFunc:       dialFunc,
-        logger:         txLogger.NewLogWrapper(logger),
-        loopStopped:    make(chan struct{}),
-        disconnect:     make(chan struct{}),
-    }
-
-    if err := client.doConnect(); err != nil {
-        client.logger = nil
-        client.loopStopped = nil
-        client.disconnect = nil
-        if client.dialConfig != nil {
-            client.dialConfig = nil
-        }
-        client = nil
-        return client, err
+        dialUrl:            dialUrl,
+        endpoints:          []string{dialUrl},
+        dialConfig:         dialConfig,
+        dialFunc:           dialFunc,
+        logger:             txLogger.NewLogWrapper(logger),
+        loopStopped:        make(chan struct{}),
+        disconnect:         make(chan struct{}),
+        shutdownDone:       make(chan struct{}),
+        reconnectPolicy:    defaultReconnectPolicy(),
+    }
+
+    for _, opt := range opts {
+        opt(client)
+    }
+
+    // the fields are left alone, a dial given up on by ctx goes on in
+    // the background
+    if err := client.doConnectContext(ctx); err != nil {
+        return nil, err
     }
 
     go client.waitClose()
@@ -89,88 +147,337 @@ func NewAmqpClientDialFunc(dialUrl string, dialConfig *amqp.Config, dialFunc Amq
     return client, nil
 }
 
-func NewAmqpClient(dialUrl string, dialConfig *amqp.Config, logger txLogger.ILogger) (*AmqpClient, error) {
-    return NewAmqpClientDialFunc(dialUrl, dialConfig, _defaultDialFunc, logger)
+func NewAmqpClient(dialUrl string, dialConfig *amqp.Config, logger txLogger.ILogger, opts ...AmqpClientOption) (*AmqpClient, error) {
+    return NewAmqpClientDialFunc(dialUrl, dialConfig, _defaultDialFunc, logger, opts...)
+}
+
+func NewAmqpClientContext(ctx context.Context, dialUrl string, dialConfig *amqp.Config, logger txLogger.ILogger, opts ...AmqpClientOption) (*AmqpClient, error) {
+    return NewAmqpClientDialFuncContext(ctx, dialUrl, dialConfig, _defaultDialFunc, logger, opts...)
 }
 
 func (c *AmqpClient) Channel() (IAmqpChannel, error) {
+    channel, _, err := c.channelGen()
+    return channel, err
+}
+
+func (c *AmqpClient) isClosed() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.closed
+}
+
+// IsFailed reports whether the reconnect policy gave up. A failed client
+// never reconnects again, it only has to be disconnected.
+func (c *AmqpClient) IsFailed() bool {
     c.mu.Lock()
     defer c.mu.Unlock()
-    return c.conn.Channel()
+    return c.failed
+}
+
+type channelResult struct {
+    channel IAmqpChannel
+    err     error
+}
+
+// ChannelContext is Channel giving up when ctx is done, a channel which
+// is opened after that is closed.
+func (c *AmqpClient) ChannelContext(ctx context.Context) (IAmqpChannel, error) {
+    result := make(chan channelResult, 1)
+
+    go func() {
+        channel, err := c.Channel()
+        result <- channelResult{channel, err}
+    }()
+
+    select {
+    case r := <- result:
+        return r.channel, r.err
+    case <- ctx.Done():
+        go func() {
+            if r := <- result; r.err == nil {
+                r.channel.Close()
+            }
+        }()
+        return nil, ctx.Err()
+    }
 }
 
 func (c *AmqpClient) Disconnect() error {
+    return c.DisconnectContext(context.Background())
+}
+
+// DisconnectContext closes the connection and stops the reconnect loop. It
+// is safe to call more than once and from several goroutines, every call
+// waits for the same shutdown. When ctx is done before the shutdown is
+// finished ctx.Err() is returned and the shutdown goes on in the background.
+// Calls after the first one return ErrClientClosed.
+func (c *AmqpClient) DisconnectContext(ctx context.Context) error {
     c.mu.Lock()
-    conn := c.conn
+    first := !c.closed
+    if first {
+        c.closed = true
+        for _, waiter := range c.connWaiters {
+            close(waiter)
+        }
+        c.connWaiters = nil
+        go c.shutdown(c.conn, c.publisher, c.disconnect, c.loopStopped)
+        c.publisher = nil
+    }
     c.mu.Unlock()
 
+    select {
+    case <- c.shutdownDone:
+    case <- ctx.Done():
+        return ctx.Err()
+    }
+
+    if !first {
+        return ErrClientClosed
+    }
+
+    return c.closeErr
+}
+
+func (c *AmqpClient) shutdown(conn IAmqpConnection, publisher *amqpPublisher, disconnect, loopStopped chan struct{}) {
+    defer close(c.shutdownDone)
+
+    if publisher != nil {
+        publisher.Stop()
+    }
+
     err := conn.Close()
 
-    close(c.disconnect)
+    close(disconnect)
+
+    <- loopStopped
 
-    <- c.loopStopped
+    c.closeEvents()
 
+    c.mu.Lock()
+    c.closeErr = err
     c.conn = nil
     c.logger = nil
     c.loopStopped = nil
     c.disconnect = nil
+    c.mu.Unlock()
+}
 
-    return err
+// log is the logger for goroutines which may outlive the client.
+func (c *AmqpClient) log() txLogger.ILogger {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.logger == nil {
+        return txLogger.NewLogWrapper(nil)
+    }
+    return c.logger
+}
+
+func (c *AmqpClient) doConnectContext(ctx context.Context) error {
+    if ctx.Done() == nil {
+        return c.doConnect()
+    }
+
+    result := make(chan error, 1)
+
+    go func() {
+        result <- c.doConnect()
+    }()
+
+    select {
+    case err := <- result:
+        return err
+    case <- ctx.Done():
+        go func() {
+            if err := <- result; err == nil {
+                c.mu.Lock()
+                conn := c.conn
+                c.mu.Unlock()
+                conn.Close()
+            }
+        }()
+        return ctx.Err()
+    }
 }
 
 func (c *AmqpClient) doConnect() error {
     if c.dialFunc == nil {
         c.dialFunc = _defaultDialFunc
     }
-    if conn, err := c.dialFunc(c.dialUrl, c.dialConfig); err != nil {
+    if conn, endpoint, err := c.dialEndpoints(); err != nil {
         return err
     } else {
         c.mu.Lock()
+        topology := c.topology
+        c.mu.Unlock()
+
+        if topology != nil {
+            if err := topology.declareOn(conn); err != nil {
+                if c.connGen == 0 {
+                    conn.Close()
+                    return err
+                }
+                c.log().Errorf("AmqpClient topology error: %s", err)
+                c.emit(AmqpEvent{Type: EventTopologyFailed, Err: err})
+            }
+        }
+
+        c.mu.Lock()
+        if c.closed {
+            c.mu.Unlock()
+            conn.Close()
+            return ErrClientClosed
+        }
         c.conn = conn
+        c.connGen++
+        c.currentUrl = c.endpoints[endpoint]
+        c.nextEndpoint = endpoint + 1
+        wasBlocked := c.blocked != nil
+        c.blocked = nil
+        for _, waiter := range c.connWaiters {
+            close(waiter)
+        }
+        c.connWaiters = nil
+        go c.watchBlocked(conn.NotifyBlocked(make(chan amqp.Blocking, 1)), c.connGen)
         c.mu.Unlock()
+
+        // a new connection starts unblocked
+        if wasBlocked {
+            c.emit(AmqpEvent{Type: EventUnblocked})
+        }
         return nil
     }
 }
 
+// channelGen opens a channel and returns the generation of its connection.
+// The channel is opened without holding the lock, it is a round-trip to the
+// broker which must not hold up Disconnect.
+func (c *AmqpClient) channelGen() (IAmqpChannel, uint64, error) {
+    for {
+        c.mu.Lock()
+        conn, gen, closed, failed := c.conn, c.connGen, c.closed, c.failed
+        c.mu.Unlock()
+
+        if closed {
+            return nil, gen, ErrClientClosed
+        }
+        if failed {
+            return nil, gen, ErrClientFailed
+        }
+
+        channel, err := conn.Channel()
+
+        if err != nil {
+            return nil, gen, err
+        }
+
+        c.mu.Lock()
+        closed, replaced := c.closed, c.connGen != gen
+        c.mu.Unlock()
+
+        if !closed && !replaced {
+            return channel, gen, nil
+        }
+
+        channel.Close()
+
+        if closed {
+            return nil, gen, ErrClientClosed
+        }
+        // reconnected meanwhile, open it on the new connection
+    }
+}
+
+// waitReconnect returns a channel which is closed once the connection
+// of generation gen has been replaced by a new one or the client has failed
+// or is closed.
+func (c *AmqpClient) waitReconnect(gen uint64) <- chan struct{} {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    waiter := make(chan struct{})
+
+    if c.connGen != gen || c.failed || c.closed {
+        close(waiter)
+    } else {
+        c.connWaiters = append(c.connWaiters, waiter)
+    }
+
+    return waiter
+}
+
 func (c *AmqpClient) waitClose() {
     defer close(c.loopStopped)
 
     for {
         closeChan := c.conn.NotifyClose(make(chan *amqp.Error))
 
-        if reason, ok := <- closeChan; !ok {
+        // the close channel is closed without a reason on Disconnect and
+        // when the connection was already gone before NotifyClose
+        if reason, ok := <- closeChan; !ok && c.isClosed() {
             return
         } else {
-            c.logger.Errorf("AmqpClient Disconnected: %#v", reason)
+            c.log().Errorf("AmqpClient Disconnected: %#v", reason)
+            c.emit(AmqpEvent{Type: EventDisconnected, Reason: reason})
 
-            connected := false
-            reconnectInterval := 2
+            if !c.reconnect() {
+                return
+            }
+        }
+    }
+}
 
-            reconnectTimer := c.conn.GetClock().Timer(time.Duration(reconnectInterval) * time.Second)
+func (c *AmqpClient) reconnect() bool {
+    clock := c.conn.GetClock()
+    disconnectedAt := clock.Now()
+    attempt := 1
 
-            for !connected {
-                c.logger.Infof("Reconnecting AmqpClient in %d seconds", reconnectInterval)
+    reconnectInterval, ok := c.reconnectPolicy.NextDelay(attempt, 0)
 
-                if reconnectInterval == 10 {
-                    reconnectInterval = 0
-                }
+    if !ok {
+        c.fail(nil)
+        return false
+    }
+
+    reconnectTimer := clock.Timer(reconnectInterval)
 
-                select {
-                case <- reconnectTimer.C:
-                    if err := c.doConnect(); err != nil {
-                        c.logger.Errorf("AmqpClient reconnecting error: %#v", err)
-                        reconnectInterval += 2
-                        reconnectTimer.Reset(time.Duration(reconnectInterval) * time.Second)
-                    } else {
-                        connected = true
-                        reconnectTimer.Stop()
-                        c.logger.Infof("AmqpClient Connected")
-                    }
-                case <- c.disconnect:
-                    reconnectTimer.Stop()
-                    return
+    for {
+        c.log().Infof("Reconnecting AmqpClient in %s", reconnectInterval)
+        c.emit(AmqpEvent{Type: EventReconnectAttempt, Attempt: attempt, Delay: reconnectInterval})
+
+        select {
+        case <- reconnectTimer.C:
+            if err := c.doConnect(); errors.Is(err, ErrClientClosed) {
+                return false
+            } else if err != nil {
+                c.log().Errorf("AmqpClient reconnecting error: %#v", err)
+                c.emit(AmqpEvent{Type: EventReconnectFailed, Attempt: attempt, Err: err})
+                attempt++
+                if reconnectInterval, ok = c.reconnectPolicy.NextDelay(attempt, clock.Now().Sub(disconnectedAt)); !ok {
+                    c.fail(err)
+                    return false
                 }
+                reconnectTimer.Reset(reconnectInterval)
+            } else {
+                reconnectTimer.Stop()
+                c.log().Infof("AmqpClient Connected")
+                c.emit(AmqpEvent{Type: EventConnected, Attempt: attempt, Endpoint: c.CurrentEndpoint()})
+                return true
             }
+        case <- c.disconnect:
+            reconnectTimer.Stop()
+            return false
         }
     }
 }
+
+func (c *AmqpClient) fail(err error) {
+    c.log().Errorf("AmqpClient gave up reconnecting, last error: %#v", err)
+    c.mu.Lock()
+    c.failed = true
+    for _, waiter := range c.connWaiters {
+        close(waiter)
+    }
+    c.connWaiters = nil
+    c.mu.Unlock()
+    c.emit(AmqpEvent{Type: EventFailed, Err: err})
+}
@@ -2,6 +2,9 @@ package client
 
 import (
     "time"
+    "errors"
+    "sync"
+    "context"
     "testing"
     "sync/atomic"
     "github.com/stretchr/testify/assert"
@@ -71,21 +74,65 @@ type FakeAmqpConnection struct {
     closeWaiter chan struct{}
     clock       *txUtils.FakeClock
     lastError   *amqp.Error
+    mu          sync.Mutex
+    closed      bool
+    channels    []*FakeAmqpChannel
+    newChannel  chan *FakeAmqpChannel
+    declareErr  func(string) error
+    blocks      []chan amqp.Blocking
 }
 
 func NewFakeAmqpConnection() *FakeAmqpConnection {
     conn := &FakeAmqpConnection{
         closeWaiter:    make(chan struct{}),
         clock:          txUtils.NewFakeClock(),
+        newChannel:     make(chan *FakeAmqpChannel, 100),
     }
     return conn
 }
 
 func (fc *FakeAmqpConnection) Channel() (IAmqpChannel, error) {
-    return &FakeAmqpChannel{}, nil
+    fc.mu.Lock()
+    defer fc.mu.Unlock()
+
+    if fc.closed {
+        return nil, amqp.ErrClosed
+    }
+
+    channel := NewFakeAmqpChannel()
+    channel.declareErr = fc.declareErr
+    fc.channels = append(fc.channels, channel)
+
+    select {
+    case fc.newChannel <- channel:
+    default:
+    }
+
+    return channel, nil
+}
+
+func (fc *FakeAmqpConnection) WaitChannel() *FakeAmqpChannel {
+    return <- fc.newChannel
+}
+
+func (fc *FakeAmqpConnection) closeChannels(reason *amqp.Error) {
+    fc.mu.Lock()
+    fc.closed = true
+    channels := fc.channels
+    fc.channels = nil
+    for _, block := range fc.blocks {
+        close(block)
+    }
+    fc.blocks = nil
+    fc.mu.Unlock()
+
+    for _, channel := range channels {
+        channel.TriggerClose(reason)
+    }
 }
 
 func (fc *FakeAmqpConnection) Close() error {
+    fc.closeChannels(nil)
     for len(fc.closeChans) > 0 {
         closeChan := fc.closeChans[0]
         fc.closeChans = fc.closeChans[1:]
@@ -101,6 +148,25 @@ func (fc *FakeAmqpConnection) NotifyClose(closeChan chan *amqp.Error) chan *amqp
     return closeChan
 }
 
+func (fc *FakeAmqpConnection) NotifyBlocked(block chan amqp.Blocking) chan amqp.Blocking {
+    fc.mu.Lock()
+    defer fc.mu.Unlock()
+    if fc.closed {
+        close(block)
+    } else {
+        fc.blocks = append(fc.blocks, block)
+    }
+    return block
+}
+
+func (fc *FakeAmqpConnection) TriggerBlocked(active bool, reason string) {
+    fc.mu.Lock()
+    defer fc.mu.Unlock()
+    for _, block := range fc.blocks {
+        block <- amqp.Blocking{Active: active, Reason: reason}
+    }
+}
+
 func (fc *FakeAmqpConnection) GetClock() txUtils.IClock {
     return fc.clock
 }
@@ -111,6 +177,7 @@ func (fc *FakeAmqpConnection) WaitNotifyClose() {
 
 func (fc *FakeAmqpConnection) TriggerClose(reason *amqp.Error) {
     fc.lastError = reason
+    fc.closeChannels(reason)
     for len(fc.closeChans) > 0 {
         closeChan := fc.closeChans[0]
         fc.closeChans = fc.closeChans[1:]
@@ -122,12 +189,274 @@ func FakeAmqpDialFunc(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection,
     return NewFakeAmqpConnection(), nil
 }
 
+type fakePublishing struct {
+    exchange    string
+    key         string
+    msg         amqp.Publishing
+    tag         uint64
+}
+
+type fakeAck struct {
+    tag         uint64
+    ack         bool
+    requeue     bool
+}
+
 type FakeAmqpChannel struct {
+    mu          sync.Mutex
+    confirming  bool
+    closed      bool
+    tag         uint64
+    confirms    []chan amqp.Confirmation
+    closes      []chan *amqp.Error
+    published   chan fakePublishing
+    consumed    chan string
+    deliveries  []chan amqp.Delivery
+    tags        []string
+    deliveryTag uint64
+    acks        chan fakeAck
+    declared    []string
+    declareErr  func(string) error
+    qos         []fakeQos
+    // confirmOnClose makes Close ack the publishings after confirmed first,
+    // like a broker confirming them before the close-ok
+    confirmOnClose  bool
+    confirmed       uint64
+}
+
+type fakeQos struct {
+    prefetch    int
+    global      bool
+}
+
+func NewFakeAmqpChannel() *FakeAmqpChannel {
+    return &FakeAmqpChannel{
+        published:  make(chan fakePublishing, 100),
+        consumed:   make(chan string, 100),
+        acks:       make(chan fakeAck, 100),
+    }
+}
+
+func (c *FakeAmqpChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<- chan amqp.Delivery, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return nil, amqp.ErrClosed
+    }
+    deliveries := make(chan amqp.Delivery)
+    c.deliveries = append(c.deliveries, deliveries)
+    c.tags = append(c.tags, consumer)
+    c.consumed <- queue
+    return deliveries, nil
+}
+
+func (c *FakeAmqpChannel) Cancel(consumer string, noWait bool) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for i, tag := range c.tags {
+        if tag == consumer {
+            close(c.deliveries[i])
+            c.deliveries = append(c.deliveries[:i], c.deliveries[i + 1:]...)
+            c.tags = append(c.tags[:i], c.tags[i + 1:]...)
+            break
+        }
+    }
+    return nil
+}
+
+func (c *FakeAmqpChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.qos = append(c.qos, fakeQos{prefetchCount, global})
+    return nil
+}
 
+func (c *FakeAmqpChannel) QosCalls() []fakeQos {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return append([]fakeQos(nil), c.qos...)
+}
+
+func (c *FakeAmqpChannel) WaitConsume() string {
+    return <- c.consumed
+}
+
+func (c *FakeAmqpChannel) Deliver(body string) uint64 {
+    c.mu.Lock()
+    c.deliveryTag++
+    tag := c.deliveryTag
+    deliveries := c.deliveries[0]
+    c.mu.Unlock()
+
+    deliveries <- amqp.Delivery{
+        Acknowledger:   c,
+        DeliveryTag:    tag,
+        Body:           []byte(body),
+    }
+    return tag
+}
+
+func (c *FakeAmqpChannel) Ack(tag uint64, multiple bool) error {
+    c.acks <- fakeAck{tag, true, false}
+    return nil
+}
+
+func (c *FakeAmqpChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+    c.acks <- fakeAck{tag, false, requeue}
+    return nil
+}
+
+func (c *FakeAmqpChannel) Reject(tag uint64, requeue bool) error {
+    return c.Nack(tag, false, requeue)
+}
+
+func (c *FakeAmqpChannel) WaitAck() fakeAck {
+    return <- c.acks
+}
+
+func (c *FakeAmqpChannel) declare(declaration string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return amqp.ErrClosed
+    }
+    if c.declareErr != nil {
+        if err := c.declareErr(declaration); err != nil {
+            return err
+        }
+    }
+    c.declared = append(c.declared, declaration)
+    return nil
+}
+
+func (c *FakeAmqpChannel) Declared() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return append([]string{}, c.declared...)
 }
 
 func (c *FakeAmqpChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
-    return amqp.Queue{}, nil
+    if err := c.declare("queue:" + name); err != nil {
+        return amqp.Queue{}, err
+    }
+    return amqp.Queue{Name: name}, nil
+}
+
+func (c *FakeAmqpChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+    return c.declare("bind:" + name + ":" + exchange + ":" + key)
+}
+
+func (c *FakeAmqpChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+    return c.declare("exchange:" + name + ":" + kind)
+}
+
+func (c *FakeAmqpChannel) Confirm(noWait bool) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return amqp.ErrClosed
+    }
+    c.confirming = true
+    return nil
+}
+
+func (c *FakeAmqpChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        close(confirm)
+    } else {
+        c.confirms = append(c.confirms, confirm)
+    }
+    return confirm
+}
+
+func (c *FakeAmqpChannel) NotifyClose(closeChan chan *amqp.Error) chan *amqp.Error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        close(closeChan)
+    } else {
+        c.closes = append(c.closes, closeChan)
+    }
+    return closeChan
+}
+
+func (c *FakeAmqpChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return amqp.ErrClosed
+    }
+    if c.confirming {
+        c.tag++
+    }
+    c.published <- fakePublishing{exchange, key, msg, c.tag}
+    return nil
+}
+
+func (c *FakeAmqpChannel) Close() error {
+    c.mu.Lock()
+    confirmOnClose, from, to := c.confirmOnClose && !c.closed, c.confirmed, c.tag
+    c.mu.Unlock()
+
+    if confirmOnClose {
+        for tag := from + 1; tag <= to; tag++ {
+            c.Confirmation(tag, true)
+        }
+    }
+
+    c.TriggerClose(nil)
+    return nil
+}
+
+func (c *FakeAmqpChannel) WaitPublished() fakePublishing {
+    return <- c.published
+}
+
+func (c *FakeAmqpChannel) Confirmation(tag uint64, ack bool) {
+    c.mu.Lock()
+    confirms := c.confirms
+    if tag > c.confirmed {
+        c.confirmed = tag
+    }
+    c.mu.Unlock()
+    for _, confirm := range confirms {
+        confirm <- amqp.Confirmation{DeliveryTag: tag, Ack: ack}
+    }
+}
+
+func (c *FakeAmqpChannel) TriggerClose(reason *amqp.Error) {
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return
+    }
+    c.closed = true
+    closes := c.closes
+    confirms := c.confirms
+    deliveries := c.deliveries
+    c.closes = nil
+    c.confirms = nil
+    c.deliveries = nil
+    c.tags = nil
+    c.mu.Unlock()
+
+    for _, delivery := range deliveries {
+        close(delivery)
+    }
+
+    if reason != nil {
+        for _, closeChan := range closes {
+            closeChan <- reason
+        }
+    }
+    for _, closeChan := range closes {
+        close(closeChan)
+    }
+    for _, confirm := range confirms {
+        close(confirm)
+    }
 }
 
 func TestAmqpClientChannel(t *testing.T) {
@@ -316,3 +645,230 @@ func TestAmqpClientDisconnectWhileReconnecting(t *testing.T) {
 
     assertDisconnected(t, client, loopStopped, disconnect)
 }
+
+type blockingAmqpConnection struct {
+    *FakeAmqpConnection
+    channelRelease  chan struct{}
+    channelOpening  chan struct{}
+    closeRelease    chan struct{}
+    closing         chan struct{}
+}
+
+func newBlockingAmqpConnection() *blockingAmqpConnection {
+    return &blockingAmqpConnection{
+        FakeAmqpConnection: NewFakeAmqpConnection(),
+        closing:            make(chan struct{}, 1),
+    }
+}
+
+func (bc *blockingAmqpConnection) Channel() (IAmqpChannel, error) {
+    if bc.channelOpening != nil {
+        bc.channelOpening <- struct{}{}
+    }
+    if bc.channelRelease != nil {
+        <- bc.channelRelease
+    }
+    return bc.FakeAmqpConnection.Channel()
+}
+
+func (bc *blockingAmqpConnection) Close() error {
+    bc.closing <- struct{}{}
+    if bc.closeRelease != nil {
+        <- bc.closeRelease
+    }
+    return bc.FakeAmqpConnection.Close()
+}
+
+func TestAmqpClientDisconnectTwice(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    loopStopped := client.loopStopped
+    disconnect := client.disconnect
+
+    client.conn.(*FakeAmqpConnection).WaitNotifyClose()
+
+    errs := make(chan error, 10)
+
+    for i := 0; i < 10; i++ {
+        go func() {
+            errs <- client.Disconnect()
+        }()
+    }
+
+    closedErrs := 0
+
+    for i := 0; i < 10; i++ {
+        if errors.Is(<- errs, ErrClientClosed) {
+            closedErrs++
+        }
+    }
+
+    assert.Equal(t, 9, closedErrs)
+    assertDisconnected(t, client, loopStopped, disconnect)
+
+    assert.ErrorIs(t, client.Disconnect(), ErrClientClosed)
+
+    _, err := client.Channel()
+    assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestAmqpClientDisconnectContext(t *testing.T) {
+    conn := newBlockingAmqpConnection()
+    conn.closeRelease = make(chan struct{})
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    loopStopped := client.loopStopped
+    disconnect := client.disconnect
+
+    conn.WaitNotifyClose()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+
+    assert.ErrorIs(t, client.DisconnectContext(ctx), context.DeadlineExceeded)
+
+    <- conn.closing
+
+    _, err := client.Channel()
+    assert.ErrorIs(t, err, ErrClientClosed)
+
+    close(conn.closeRelease)
+
+    assert.ErrorIs(t, client.Disconnect(), ErrClientClosed)
+    assertDisconnected(t, client, loopStopped, disconnect)
+}
+
+func TestAmqpClientDisconnectContextChannelOpening(t *testing.T) {
+    conn := newBlockingAmqpConnection()
+    conn.channelOpening = make(chan struct{}, 1)
+    conn.channelRelease = make(chan struct{})
+    conn.closeRelease = make(chan struct{})
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    loopStopped := client.loopStopped
+    disconnect := client.disconnect
+
+    conn.WaitNotifyClose()
+
+    result := make(chan error, 1)
+
+    go func() {
+        _, err := client.Channel()
+        result <- err
+    }()
+
+    <- conn.channelOpening
+
+    // the channel being opened does not hold up the deadline
+    ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+    defer cancel()
+
+    assert.ErrorIs(t, client.DisconnectContext(ctx), context.DeadlineExceeded)
+
+    // the channel opened after the disconnect is closed
+    close(conn.channelRelease)
+    assert.ErrorIs(t, <- result, ErrClientClosed)
+
+    _, ok := <- conn.WaitChannel().NotifyClose(make(chan *amqp.Error, 1))
+    assert.False(t, ok)
+
+    close(conn.closeRelease)
+
+    assert.ErrorIs(t, client.Disconnect(), ErrClientClosed)
+    assertDisconnected(t, client, loopStopped, disconnect)
+}
+
+func TestNewAmqpClientContext(t *testing.T) {
+    conn := newBlockingAmqpConnection()
+    release := make(chan struct{})
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        <- release
+        return conn, nil
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    client, err := NewAmqpClientDialFuncContext(ctx, _DIAL_URL_TEST, nil, dialFn, nil)
+
+    assert.Nil(t, client)
+    assert.ErrorIs(t, err, context.Canceled)
+
+    // the connection dialed after giving up is closed
+    close(release)
+    <- conn.closing
+}
+
+func TestNewAmqpClientContextEndpointsFail(t *testing.T) {
+    release := make(chan struct{})
+    dialed := make(chan string, 2)
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        <- release
+        dialed <- dialUrl
+        return nil, errors.New("dial failed")
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    client, err := NewAmqpClientDialFuncContext(ctx, _DIAL_URL_TEST, nil, dialFn, nil, WithEndpoints(SelectPriority, "amqp://fallback"))
+
+    assert.Nil(t, client)
+    assert.ErrorIs(t, err, context.Canceled)
+
+    // the dial going on in the background still logs its failures
+    close(release)
+    assert.Equal(t, _DIAL_URL_TEST, <- dialed)
+    assert.Equal(t, "amqp://fallback", <- dialed)
+}
+
+func TestAmqpClientChannelContext(t *testing.T) {
+    conn := newBlockingAmqpConnection()
+    conn.channelRelease = make(chan struct{})
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+    conn.WaitNotifyClose()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    channel, err := client.ChannelContext(ctx)
+
+    assert.Nil(t, channel)
+    assert.ErrorIs(t, err, context.Canceled)
+
+    conn.channelRelease <- struct{}{}
+
+    // the channel opened after giving up is closed
+    _, ok := <- conn.WaitChannel().NotifyClose(make(chan *amqp.Error, 1))
+    assert.False(t, ok)
+
+    close(conn.channelRelease)
+
+    channel, err = client.ChannelContext(context.Background())
+
+    assert.Nil(t, err)
+    assert.NotNil(t, channel)
+
+    go func() {
+        <- conn.closing
+    }()
+
+    client.Disconnect()
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+// BlockedError is returned by Publish while the broker blocks the
+// connection, when the client was created with WithFailFastWhenBlocked.
+type BlockedError struct {
+    Reason  string
+}
+
+func (e *BlockedError) Error() string {
+    return "amqp: connection blocked by broker: " + e.Reason
+}
+
+// WithFailFastWhenBlocked makes Publish fail with *BlockedError instead of
+// waiting while the broker blocks publishing because of a resource alarm.
+func WithFailFastWhenBlocked() AmqpClientOption {
+    return func(c *AmqpClient) {
+        c.failFastBlocked = true
+    }
+}
+
+// IsBlocked reports whether the broker blocks the current connection.
+func (c *AmqpClient) IsBlocked() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.blocked != nil
+}
+
+// watchBlocked tracks the connection.blocked notifications of the
+// connection of generation gen until it is closed.
+func (c *AmqpClient) watchBlocked(blocks <- chan amqp.Blocking, gen uint64) {
+    for blocking := range blocks {
+        c.mu.Lock()
+        if c.connGen != gen {
+            c.mu.Unlock()
+            continue
+        }
+        wasBlocked := c.blocked != nil
+        if blocking.Active {
+            c.blocked = &BlockedError{blocking.Reason}
+        } else {
+            c.blocked = nil
+        }
+        c.mu.Unlock()
+
+        if blocking.Active {
+            c.log().Warnf("AmqpClient blocked by broker: %s", blocking.Reason)
+            c.emit(AmqpEvent{Type: EventBlocked, Err: &BlockedError{blocking.Reason}})
+        } else if wasBlocked {
+            c.log().Infof("AmqpClient unblocked by broker")
+            c.emit(AmqpEvent{Type: EventUnblocked})
+        }
+    }
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+    "time"
+    "errors"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+func TestAmqpClientBlocked(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithFailFastWhenBlocked(), WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs"}},
+    }))
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    assert.False(t, client.IsBlocked())
+
+    broker.SetBlocked(true, "low on memory")
+
+    event := waitEvent(events, EventBlocked)
+    assert.Equal(t, &BlockedError{"low on memory"}, event.Err)
+    assert.True(t, client.IsBlocked())
+
+    err := client.Publish(context.Background(), "", "jobs", amqp.Publishing{})
+
+    var blockedError *BlockedError
+    assert.True(t, errors.As(err, &blockedError))
+    assert.Equal(t, "low on memory", blockedError.Reason)
+    assert.Equal(t, 0, broker.QueueMessages("jobs"))
+
+    broker.SetBlocked(false, "")
+
+    waitEvent(events, EventUnblocked)
+    assert.False(t, client.IsBlocked())
+
+    assert.Nil(t, client.Publish(context.Background(), "", "jobs", amqp.Publishing{}))
+    assert.Equal(t, 1, broker.QueueMessages("jobs"))
+
+    client.Disconnect()
+}
+
+func TestAmqpClientBlockedWithoutFailFast(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs"}},
+    }))
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    broker.SetBlocked(true, "low on disk")
+    waitEvent(events, EventBlocked)
+
+    assert.True(t, client.IsBlocked())
+    assert.Nil(t, client.Publish(context.Background(), "", "jobs", amqp.Publishing{}))
+
+    client.Disconnect()
+}
+
+func TestAmqpClientBlockedReconnect(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    broker := NewFakeBroker(clock)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil)
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    broker.SetBlocked(true, "low on memory")
+    waitEvent(events, EventBlocked)
+
+    broker.DropConnections(nil)
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(2 * time.Second)
+
+    // the new connection is not blocked
+    waitEvent(events, EventUnblocked)
+    assert.False(t, client.IsBlocked())
+    assert.Equal(t, EventConnected, (<- events).Type)
+
+    client.Disconnect()
+}
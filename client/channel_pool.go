@@ -0,0 +1,194 @@
+package client
+
+import (
+    "sync"
+    "errors"
+    "context"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+var (
+    ErrPoolClosed = errors.New("amqp: channel pool closed")
+)
+
+// PooledChannel is a channel borrowed from an AmqpChannelPool. It must be
+// given back with AmqpChannelPool.Return, even when it was closed.
+type PooledChannel struct {
+    IAmqpChannel
+    closes      chan *amqp.Error
+    closed      bool
+    err         *amqp.Error
+}
+
+// Closed reports whether the channel, or its connection, was closed.
+func (pc *PooledChannel) Closed() bool {
+    if !pc.closed {
+        select {
+        case err, ok := <- pc.closes:
+            pc.closed = true
+            if ok {
+                pc.err = err
+            }
+        default:
+        }
+    }
+    return pc.closed
+}
+
+// Err returns the exception which closed the channel, if any.
+func (pc *PooledChannel) Err() *amqp.Error {
+    pc.Closed()
+    return pc.err
+}
+
+// AmqpChannelPool bounds the number of channels opened on an AmqpClient.
+// Closed channels are discarded when borrowed or returned and replaced by
+// new ones, waiting for the client to reconnect when needed.
+type AmqpChannelPool struct {
+    client      *AmqpClient
+    mu          sync.Mutex
+    idle        []*PooledChannel
+    slots       chan struct{}
+    closed      chan struct{}
+    closeOnce   sync.Once
+}
+
+func NewAmqpChannelPool(client *AmqpClient, size int) *AmqpChannelPool {
+    if size <= 0 {
+        size = 1
+    }
+
+    pool := &AmqpChannelPool{
+        client:     client,
+        slots:      make(chan struct{}, size),
+        closed:     make(chan struct{}),
+    }
+
+    return pool
+}
+
+// Borrow returns an open channel, blocking while all channels are borrowed
+// or while the client is reconnecting.
+func (p *AmqpChannelPool) Borrow(ctx context.Context) (*PooledChannel, error) {
+    select {
+    case <- p.closed:
+        return nil, ErrPoolClosed
+    default:
+    }
+
+    select {
+    case p.slots <- struct{}{}:
+    case <- p.closed:
+        return nil, ErrPoolClosed
+    case <- ctx.Done():
+        return nil, ctx.Err()
+    }
+
+    if channel := p.popIdle(); channel != nil {
+        return channel, nil
+    }
+
+    for {
+        channel, gen, err := p.client.channelGen()
+
+        if err == nil {
+            return p.newPooledChannel(channel), nil
+        }
+
+        if errors.Is(err, ErrClientFailed) || errors.Is(err, ErrClientClosed) {
+            <- p.slots
+            return nil, err
+        }
+
+        select {
+        case <- p.client.waitReconnect(gen):
+        case <- p.closed:
+            <- p.slots
+            return nil, ErrPoolClosed
+        case <- ctx.Done():
+            <- p.slots
+            return nil, ctx.Err()
+        }
+    }
+}
+
+// Return gives back a borrowed channel. Closed channels are dropped.
+func (p *AmqpChannelPool) Return(channel *PooledChannel) {
+    defer func() {
+        <- p.slots
+    }()
+
+    if channel.Closed() {
+        return
+    }
+
+    select {
+    case <- p.closed:
+        channel.Close()
+        return
+    default:
+    }
+
+    p.mu.Lock()
+    p.idle = append(p.idle, channel)
+    p.mu.Unlock()
+}
+
+// Do borrows a channel, calls fn with it and returns the channel.
+func (p *AmqpChannelPool) Do(ctx context.Context, fn func(IAmqpChannel) error) error {
+    channel, err := p.Borrow(ctx)
+
+    if err != nil {
+        return err
+    }
+
+    defer p.Return(channel)
+
+    return fn(channel)
+}
+
+// Idle returns the number of open channels waiting to be borrowed.
+func (p *AmqpChannelPool) Idle() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return len(p.idle)
+}
+
+// Close closes the idle channels, borrowed channels are closed when returned.
+func (p *AmqpChannelPool) Close() {
+    p.closeOnce.Do(func() {
+        close(p.closed)
+    })
+
+    p.mu.Lock()
+    idle := p.idle
+    p.idle = nil
+    p.mu.Unlock()
+
+    for _, channel := range idle {
+        channel.Close()
+    }
+}
+
+func (p *AmqpChannelPool) popIdle() *PooledChannel {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    for len(p.idle) > 0 {
+        channel := p.idle[len(p.idle) - 1]
+        p.idle = p.idle[:len(p.idle) - 1]
+        if !channel.Closed() {
+            return channel
+        }
+    }
+
+    return nil
+}
+
+func (p *AmqpChannelPool) newPooledChannel(channel IAmqpChannel) *PooledChannel {
+    return &PooledChannel{
+        IAmqpChannel:   channel,
+        closes:         channel.NotifyClose(make(chan *amqp.Error, 1)),
+    }
+}
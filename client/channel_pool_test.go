@@ -0,0 +1,184 @@
+package client
+
+import (
+    "time"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+func TestAmqpChannelPoolBorrowReturn(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 2)
+
+    channel, err := pool.Borrow(context.Background())
+
+    assert.Nil(t, err)
+    assert.Same(t, conn.WaitChannel(), channel.IAmqpChannel)
+    assert.False(t, channel.Closed())
+    assert.Equal(t, 0, pool.Idle())
+
+    pool.Return(channel)
+
+    assert.Equal(t, 1, pool.Idle())
+
+    borrowed, err := pool.Borrow(context.Background())
+
+    assert.Nil(t, err)
+    assert.Same(t, channel, borrowed)
+    assert.Equal(t, 0, pool.Idle())
+    assert.Empty(t, conn.newChannel)
+
+    pool.Return(borrowed)
+}
+
+func TestAmqpChannelPoolBounded(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 1)
+
+    channel, _ := pool.Borrow(context.Background())
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+
+    _, err := pool.Borrow(ctx)
+    assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+    borrowed := make(chan *PooledChannel)
+
+    go func() {
+        channel, _ := pool.Borrow(context.Background())
+        borrowed <- channel
+    }()
+
+    pool.Return(channel)
+
+    assert.Same(t, channel, <- borrowed)
+}
+
+func TestAmqpChannelPoolDiscardClosed(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 1)
+
+    channel, _ := pool.Borrow(context.Background())
+
+    reason := &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED", Server: true, Recover: true}
+
+    conn.WaitChannel().TriggerClose(reason)
+
+    assert.True(t, channel.Closed())
+    assert.Equal(t, reason, channel.Err())
+
+    pool.Return(channel)
+
+    assert.Equal(t, 0, pool.Idle())
+
+    borrowed, err := pool.Borrow(context.Background())
+
+    assert.Nil(t, err)
+    assert.NotSame(t, channel, borrowed)
+    assert.Same(t, conn.WaitChannel(), borrowed.IAmqpChannel)
+}
+
+func TestAmqpChannelPoolRecover(t *testing.T) {
+    conns := make(chan *FakeAmqpConnection, 10)
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        conn := NewFakeAmqpConnection()
+        conns <- conn
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    conn := <- conns
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 2)
+
+    channel, _ := pool.Borrow(context.Background())
+    pool.Return(channel)
+
+    triggerForcedClose(conn)
+
+    conn.clock.WaitUntilBlock(1)
+
+    borrowed := make(chan *PooledChannel)
+
+    go func() {
+        channel, _ := pool.Borrow(context.Background())
+        borrowed <- channel
+    }()
+
+    conn.clock.Advance(2 * time.Second)
+
+    newConn := <- conns
+    newConn.WaitNotifyClose()
+
+    newChannel := <- borrowed
+
+    assert.True(t, channel.Closed())
+    assert.False(t, newChannel.Closed())
+    assert.Same(t, newConn.WaitChannel(), newChannel.IAmqpChannel)
+}
+
+func TestAmqpChannelPoolDo(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 1)
+
+    doError := &connectError{}
+
+    err := pool.Do(context.Background(), func(channel IAmqpChannel) error {
+        assert.Same(t, conn.WaitChannel(), channel.(*PooledChannel).IAmqpChannel)
+        return doError
+    })
+
+    assert.ErrorIs(t, err, doError)
+    assert.Equal(t, 1, pool.Idle())
+}
+
+func TestAmqpChannelPoolClose(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    pool := NewAmqpChannelPool(client, 2)
+
+    idle, _ := pool.Borrow(context.Background())
+    borrowed, _ := pool.Borrow(context.Background())
+    pool.Return(idle)
+
+    pool.Close()
+
+    assert.True(t, idle.Closed())
+    assert.Equal(t, 0, pool.Idle())
+
+    _, err := pool.Borrow(context.Background())
+    assert.ErrorIs(t, err, ErrPoolClosed)
+
+    pool.Return(borrowed)
+
+    assert.True(t, borrowed.Closed())
+    assert.Equal(t, 0, pool.Idle())
+
+    pool.Close()
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+    "fmt"
+    "bytes"
+    "context"
+    "strings"
+    "encoding/gob"
+    "encoding/json"
+    "github.com/vmihailenco/msgpack/v5"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+var _ Codec = JSONCodec
+var _ Codec = GobCodec
+var _ Codec = MsgpackCodec
+
+// Codec turns values into message bodies of its content type and back.
+type Codec interface {
+    ContentType()                           string
+    Marshal(v interface{})                  ([]byte, error)
+    Unmarshal(data []byte, v interface{})   error
+}
+
+var (
+    JSONCodec       = jsonCodec{}
+    GobCodec        = gobCodec{}
+    MsgpackCodec    = msgpackCodec{}
+)
+
+// DefaultCodecs decodes json, gob and msgpack bodies, json being used for
+// deliveries without content type.
+var DefaultCodecs = NewCodecs(JSONCodec, GobCodec, MsgpackCodec)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+    return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+    return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+    return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+    return "application/x-gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+    return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+    return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+    return msgpack.Unmarshal(data, v)
+}
+
+// UnknownContentTypeError is returned when no codec is registered for the
+// content type of a delivery.
+type UnknownContentTypeError struct {
+    ContentType string
+}
+
+func (e *UnknownContentTypeError) Error() string {
+    return fmt.Sprintf("amqp: no codec for content type %q", e.ContentType)
+}
+
+// Codecs picks a codec by content type, parameters like charset are
+// ignored. The first codec is used for an empty content type.
+type Codecs struct {
+    fallback    Codec
+    codecs      map[string]Codec
+}
+
+func NewCodecs(fallback Codec, others ...Codec) *Codecs {
+    codecs := &Codecs{
+        fallback:   fallback,
+        codecs:     make(map[string]Codec),
+    }
+
+    for _, codec := range append([]Codec{fallback}, others...) {
+        codecs.codecs[codec.ContentType()] = codec
+    }
+
+    return codecs
+}
+
+func (c *Codecs) Lookup(contentType string) (Codec, error) {
+    mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+
+    if mediaType == "" {
+        return c.fallback, nil
+    }
+
+    if codec, ok := c.codecs[mediaType]; ok {
+        return codec, nil
+    }
+
+    // msgpack has no registered media type, both spellings are in use
+    if mediaType == "application/x-msgpack" {
+        if codec, ok := c.codecs["application/msgpack"]; ok {
+            return codec, nil
+        }
+    }
+
+    return nil, &UnknownContentTypeError{contentType}
+}
+
+// Encode sets the body of msg to v encoded with codec and its content type.
+func Encode(codec Codec, v interface{}, msg amqp.Publishing) (amqp.Publishing, error) {
+    body, err := codec.Marshal(v)
+
+    if err != nil {
+        return msg, err
+    }
+
+    msg.ContentType = codec.ContentType()
+    msg.Body = body
+
+    return msg, nil
+}
+
+// PublishValue publishes v encoded with codec, see Publish.
+func (c *AmqpClient) PublishValue(ctx context.Context, exchange, key string, codec Codec, v interface{}) error {
+    msg, err := Encode(codec, v, amqp.Publishing{})
+
+    if err != nil {
+        return err
+    }
+
+    return c.Publish(ctx, exchange, key, msg)
+}
+
+// Decode decodes the delivery body with the codec of its content type.
+func Decode[T any](codecs *Codecs, delivery amqp.Delivery) (T, error) {
+    var value T
+
+    codec, err := codecs.Lookup(delivery.ContentType)
+
+    if err != nil {
+        return value, err
+    }
+
+    err = codec.Unmarshal(delivery.Body, &value)
+
+    return value, err
+}
+
+// DecodingHandler decodes every delivery into T before calling handler,
+// the decode error is returned otherwise. Wrap it with
+// NewAmqpDeliveryHandler or AmqpRetry.Handler.
+func DecodingHandler[T any](codecs *Codecs, handler func(amqp.Delivery, T) error) func(amqp.Delivery) error {
+    return func(delivery amqp.Delivery) error {
+        value, err := Decode[T](codecs, delivery)
+
+        if err != nil {
+            return err
+        }
+
+        return handler(delivery, value)
+    }
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+    "errors"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txWorker "github.com/serenity-77/bagudung/worker"
+)
+
+
+type testOrder struct {
+    Id      int64
+    Item    string
+    Tags    []string
+}
+
+func TestCodecs(t *testing.T) {
+    order := testOrder{Id: 7, Item: "book", Tags: []string{"a", "b"}}
+
+    for _, codec := range []Codec{JSONCodec, GobCodec, MsgpackCodec} {
+        msg, err := Encode(codec, order, amqp.Publishing{MessageId: "1"})
+
+        assert.Nil(t, err)
+        assert.Equal(t, codec.ContentType(), msg.ContentType)
+        assert.Equal(t, "1", msg.MessageId)
+
+        decoded, err := Decode[testOrder](DefaultCodecs, amqp.Delivery{ContentType: msg.ContentType, Body: msg.Body})
+
+        assert.Nil(t, err)
+        assert.Equal(t, order, decoded)
+    }
+}
+
+func TestCodecsLookup(t *testing.T) {
+    codec, err := DefaultCodecs.Lookup("")
+    assert.Nil(t, err)
+    assert.Equal(t, JSONCodec, codec)
+
+    codec, err = DefaultCodecs.Lookup("Application/JSON; charset=utf-8")
+    assert.Nil(t, err)
+    assert.Equal(t, JSONCodec, codec)
+
+    codec, err = DefaultCodecs.Lookup("application/x-msgpack")
+    assert.Nil(t, err)
+    assert.Equal(t, MsgpackCodec, codec)
+
+    _, err = DefaultCodecs.Lookup("text/plain")
+
+    var unknown *UnknownContentTypeError
+    assert.True(t, errors.As(err, &unknown))
+    assert.Equal(t, "text/plain", unknown.ContentType)
+
+    codec, err = NewCodecs(GobCodec).Lookup("")
+    assert.Nil(t, err)
+    assert.Equal(t, GobCodec, codec)
+}
+
+func TestDecodingHandler(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "orders"}},
+    }))
+
+    orders := make(chan testOrder, 10)
+
+    worker := txWorker.NewWorker(
+        txWorker.NewProducer(NewAmqpProducerHandler(client, "orders", nil)),
+        txWorker.NewConsumer(NewAmqpDeliveryHandler(DecodingHandler(DefaultCodecs, func(delivery amqp.Delivery, order testOrder) error {
+            orders <- order
+            return nil
+        }), false), 1),
+    )
+
+    assert.Nil(t, client.PublishValue(context.Background(), "", "orders", MsgpackCodec, testOrder{Id: 1, Item: "pen"}))
+    assert.Nil(t, client.PublishValue(context.Background(), "", "orders", JSONCodec, testOrder{Id: 2, Item: "ink"}))
+
+    assert.Equal(t, testOrder{Id: 1, Item: "pen"}, <- orders)
+    assert.Equal(t, testOrder{Id: 2, Item: "ink"}, <- orders)
+
+    // undecodable deliveries are nacked
+    assert.Nil(t, client.Publish(context.Background(), "", "orders", amqp.Publishing{ContentType: "text/plain", Body: []byte("x")}))
+    assert.Nil(t, client.PublishValue(context.Background(), "", "orders", GobCodec, testOrder{Id: 3}))
+
+    assert.Equal(t, testOrder{Id: 3}, <- orders)
+
+    worker.Stop()
+    client.Disconnect()
+
+    assert.Equal(t, 0, broker.QueueMessages("orders"))
+}
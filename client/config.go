@@ -0,0 +1,337 @@
+package client
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "time"
+    "context"
+    "net/url"
+    "strconv"
+    "strings"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "path/filepath"
+    "gopkg.in/yaml.v3"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txLogger "github.com/serenity-77/bagudung/logger"
+)
+
+
+// AmqpConfig describes how to reach the broker. Hosts are "host" or
+// "host:port", the port defaults to 5671 with TLS and 5672 without. More
+// than one host makes the client fail over between them, see WithEndpoints.
+// Heartbeat is a duration string like "10s".
+type AmqpConfig struct {
+    Hosts               []string    `json:"hosts" yaml:"hosts"`
+    Username            string      `json:"username" yaml:"username"`
+    Password            string      `json:"password" yaml:"password"`
+    PasswordFile        string      `json:"password_file" yaml:"password_file"`
+    Vhost               string      `json:"vhost" yaml:"vhost"`
+    TLS                 bool        `json:"tls" yaml:"tls"`
+    CAFile              string      `json:"ca_file" yaml:"ca_file"`
+    CertFile            string      `json:"cert_file" yaml:"cert_file"`
+    KeyFile             string      `json:"key_file" yaml:"key_file"`
+    ServerName          string      `json:"server_name" yaml:"server_name"`
+    InsecureSkipVerify  bool        `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+    ExternalAuth        bool        `json:"external_auth" yaml:"external_auth"`
+    Heartbeat           string      `json:"heartbeat" yaml:"heartbeat"`
+    ConnectionName      string      `json:"connection_name" yaml:"connection_name"`
+    ClientProperties    amqp.Table  `json:"client_properties" yaml:"client_properties"`
+}
+
+// AmqpConfigError tells which field of AmqpConfig is wrong.
+type AmqpConfigError struct {
+    Field   string
+    Err     error
+}
+
+func (e *AmqpConfigError) Error() string {
+    return fmt.Sprintf("amqp config %s: %s", e.Field, e.Err)
+}
+
+func (e *AmqpConfigError) Unwrap() error {
+    return e.Err
+}
+
+func configError(field, format string, args ...interface{}) error {
+    return &AmqpConfigError{field, fmt.Errorf(format, args...)}
+}
+
+// LoadAmqpConfigFile reads a .json, .yaml or .yml config file.
+func LoadAmqpConfigFile(path string) (*AmqpConfig, error) {
+    data, err := os.ReadFile(path)
+
+    if err != nil {
+        return nil, err
+    }
+
+    config := &AmqpConfig{}
+
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        err = json.Unmarshal(data, config)
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(data, config)
+    default:
+        return nil, fmt.Errorf("amqp: unknown config file format %q", path)
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    normalizeTable(config.ClientProperties)
+
+    return config, nil
+}
+
+// LoadAmqpConfigEnv reads the config from environment variables named
+// prefix followed by HOSTS (comma separated), USERNAME, PASSWORD,
+// PASSWORD_FILE, VHOST, TLS, CA_FILE, CERT_FILE, KEY_FILE, SERVER_NAME,
+// INSECURE_SKIP_VERIFY, EXTERNAL_AUTH, HEARTBEAT and CONNECTION_NAME.
+func LoadAmqpConfigEnv(prefix string) (*AmqpConfig, error) {
+    config := &AmqpConfig{}
+
+    texts := map[string]*string{
+        "USERNAME":         &config.Username,
+        "PASSWORD":         &config.Password,
+        "PASSWORD_FILE":    &config.PasswordFile,
+        "VHOST":            &config.Vhost,
+        "CA_FILE":          &config.CAFile,
+        "CERT_FILE":        &config.CertFile,
+        "KEY_FILE":         &config.KeyFile,
+        "SERVER_NAME":      &config.ServerName,
+        "HEARTBEAT":        &config.Heartbeat,
+        "CONNECTION_NAME":  &config.ConnectionName,
+    }
+
+    for name, field := range texts {
+        if value, ok := os.LookupEnv(prefix + name); ok {
+            *field = value
+        }
+    }
+
+    bools := map[string]*bool{
+        "TLS":                  &config.TLS,
+        "INSECURE_SKIP_VERIFY": &config.InsecureSkipVerify,
+        "EXTERNAL_AUTH":        &config.ExternalAuth,
+    }
+
+    for name, field := range bools {
+        if value, ok := os.LookupEnv(prefix + name); ok && value != "" {
+            parsed, err := strconv.ParseBool(value)
+            if err != nil {
+                return nil, configError(prefix + name, "%q is not a boolean", value)
+            }
+            *field = parsed
+        }
+    }
+
+    if value, ok := os.LookupEnv(prefix + "HOSTS"); ok {
+        for _, host := range strings.Split(value, ",") {
+            if host = strings.TrimSpace(host); host != "" {
+                config.Hosts = append(config.Hosts, host)
+            }
+        }
+    }
+
+    return config, nil
+}
+
+// Validate checks the config without touching the file system.
+func (c *AmqpConfig) Validate() error {
+    if len(c.Hosts) == 0 {
+        return configError("hosts", "at least one host is required")
+    }
+
+    for _, host := range c.Hosts {
+        if _, _, err := c.hostPort(host); err != nil {
+            return err
+        }
+    }
+
+    if c.Password != "" && c.PasswordFile != "" {
+        return configError("password", "password and password_file are exclusive")
+    }
+
+    if !c.TLS && (c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify) {
+        return configError("tls", "tls options are set but tls is disabled")
+    }
+
+    if (c.CertFile == "") != (c.KeyFile == "") {
+        return configError("cert_file", "cert_file and key_file have to be set together")
+    }
+
+    if c.ExternalAuth {
+        if c.CertFile == "" {
+            return configError("external_auth", "EXTERNAL auth needs tls with a client certificate")
+        }
+        if c.Password != "" || c.PasswordFile != "" {
+            return configError("external_auth", "EXTERNAL auth does not use a password")
+        }
+    } else if c.Username == "" {
+        return configError("username", "username is required without EXTERNAL auth")
+    }
+
+    if c.Heartbeat != "" {
+        if heartbeat, err := time.ParseDuration(c.Heartbeat); err != nil {
+            return configError("heartbeat", "%s", err)
+        } else if heartbeat < 0 {
+            return configError("heartbeat", "must not be negative")
+        }
+    }
+
+    return nil
+}
+
+func (c *AmqpConfig) hostPort(host string) (string, int, error) {
+    port := 5672
+    if c.TLS {
+        port = 5671
+    }
+
+    if !strings.Contains(host, ":") || (strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")) {
+        return strings.Trim(host, "[]"), port, nil
+    }
+
+    name, portString, err := net.SplitHostPort(host)
+
+    if err != nil {
+        return "", 0, configError("hosts", "%q: %s", host, err)
+    }
+
+    port, err = strconv.Atoi(portString)
+
+    if err != nil || port < 1 || port > 65535 {
+        return "", 0, configError("hosts", "%q: invalid port %q", host, portString)
+    }
+
+    if name == "" {
+        return "", 0, configError("hosts", "%q: missing host name", host)
+    }
+
+    return name, port, nil
+}
+
+// Build validates the config, loads the certificate and password files and
+// returns one dial url per host with the amqp.Config to dial them with.
+func (c *AmqpConfig) Build() ([]string, *amqp.Config, error) {
+    if err := c.Validate(); err != nil {
+        return nil, nil, err
+    }
+
+    dialConfig := &amqp.Config{
+        Vhost:      c.Vhost,
+        Properties: amqp.NewConnectionProperties(),
+    }
+
+    if dialConfig.Vhost == "" {
+        dialConfig.Vhost = "/"
+    }
+
+    for key, value := range c.ClientProperties {
+        dialConfig.Properties[key] = value
+    }
+
+    if c.ConnectionName != "" {
+        dialConfig.Properties.SetClientConnectionName(c.ConnectionName)
+    }
+
+    if c.Heartbeat != "" {
+        dialConfig.Heartbeat, _ = time.ParseDuration(c.Heartbeat)
+    }
+
+    if c.TLS {
+        tlsConfig, err := c.tlsConfig()
+        if err != nil {
+            return nil, nil, err
+        }
+        dialConfig.TLSClientConfig = tlsConfig
+    }
+
+    if c.ExternalAuth {
+        dialConfig.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+    }
+
+    password := c.Password
+
+    if c.PasswordFile != "" {
+        data, err := os.ReadFile(c.PasswordFile)
+        if err != nil {
+            return nil, nil, &AmqpConfigError{"password_file", err}
+        }
+        password = strings.TrimRight(string(data), "\r\n")
+    }
+
+    scheme := "amqp"
+    if c.TLS {
+        scheme = "amqps"
+    }
+
+    urls := make([]string, 0, len(c.Hosts))
+
+    for _, host := range c.Hosts {
+        name, port, _ := c.hostPort(host)
+
+        dialUrl := &url.URL{
+            Scheme:     scheme,
+            Host:       net.JoinHostPort(name, strconv.Itoa(port)),
+            Path:       "/" + dialConfig.Vhost,
+            RawPath:    "/" + url.PathEscape(dialConfig.Vhost),
+        }
+
+        if !c.ExternalAuth {
+            dialUrl.User = url.UserPassword(c.Username, password)
+        }
+
+        urls = append(urls, dialUrl.String())
+    }
+
+    return urls, dialConfig, nil
+}
+
+func (c *AmqpConfig) tlsConfig() (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        ServerName:         c.ServerName,
+        InsecureSkipVerify: c.InsecureSkipVerify,
+        MinVersion:         tls.VersionTLS12,
+    }
+
+    if c.CAFile != "" {
+        pem, err := os.ReadFile(c.CAFile)
+        if err != nil {
+            return nil, &AmqpConfigError{"ca_file", err}
+        }
+        tlsConfig.RootCAs = x509.NewCertPool()
+        if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, configError("ca_file", "no PEM certificate found in %s", c.CAFile)
+        }
+    }
+
+    if c.CertFile != "" {
+        cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+        if err != nil {
+            return nil, &AmqpConfigError{"cert_file", err}
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    return tlsConfig, nil
+}
+
+// NewAmqpClientConfig builds config and connects to it. The hosts are
+// selected round robin, a WithEndpoints in opts adds its urls after them
+// and changes the selection.
+func NewAmqpClientConfig(ctx context.Context, config *AmqpConfig, logger txLogger.ILogger, opts ...AmqpClientOption) (*AmqpClient, error) {
+    urls, dialConfig, err := config.Build()
+
+    if err != nil {
+        return nil, err
+    }
+
+    opts = append([]AmqpClientOption{WithEndpoints(SelectRoundRobin, urls[1:]...)}, opts...)
+
+    return NewAmqpClientDialFuncContext(ctx, urls[0], dialConfig, _defaultDialFunc, logger, opts...)
+}
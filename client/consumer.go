@@ -0,0 +1,254 @@
+package client
+
+import (
+    "fmt"
+    "sync"
+    "errors"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txWorker "github.com/serenity-77/bagudung/worker"
+)
+
+
+var _ txWorker.IProducerHandler = (*AmqpProducerHandler)(nil)
+
+// AmqpProducerHandler consumes a queue and enqueues every amqp.Delivery into
+// the worker queue. Deliveries are consumed with manual acknowledgement, use
+// NewAmqpDeliveryHandler on the consumer side to ack or nack them.
+//
+// Without a prefetch option the broker default is used, which for RabbitMQ
+// means no limit at all.
+type AmqpProducerHandler struct {
+    client          *AmqpClient
+    queue           string
+    args            amqp.Table
+    stop            chan struct{}
+    stopWait        chan struct{}
+    mu              sync.Mutex
+    channel         IAmqpChannel
+    tag             string
+    consumes        uint64
+    cancelled       bool
+    prefetch        int
+    prefetchGlobal  bool
+    prefetchSet     bool
+}
+
+type AmqpProducerOption func(*AmqpProducerHandler)
+
+// WithPrefetch sets basic.qos before consuming. With global the count is
+// the limit of the whole channel, otherwise of the consumer. RabbitMQ
+// counts both the same way here as the handler has one consumer per channel.
+func WithPrefetch(count int, global bool) AmqpProducerOption {
+    return func(h *AmqpProducerHandler) {
+        h.prefetch = count
+        h.prefetchGlobal = global
+        h.prefetchSet = true
+    }
+}
+
+// WithConsumerPrefetch sets the prefetch count to the worker number of
+// consumer, so every worker has a delivery at hand, see WithPrefetch.
+func WithConsumerPrefetch(consumer *txWorker.Consumer, global bool) AmqpProducerOption {
+    return WithPrefetch(consumer.WorkerNum(), global)
+}
+
+
+func NewAmqpProducerHandler(client *AmqpClient, queue string, args amqp.Table, opts ...AmqpProducerOption) *AmqpProducerHandler {
+    handler := &AmqpProducerHandler{
+        client:     client,
+        queue:      queue,
+        args:       args,
+        stop:       make(chan struct{}),
+        stopWait:   make(chan struct{}),
+    }
+    for _, opt := range opts {
+        opt(handler)
+    }
+    return handler
+}
+
+// SetPrefetch changes the prefetch count while consuming. The consumer is
+// cancelled and started again on the same channel, so the deliveries not
+// acked yet stay valid and are not redelivered.
+func (h *AmqpProducerHandler) SetPrefetch(count int, global bool) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.prefetch = count
+    h.prefetchGlobal = global
+    h.prefetchSet = true
+
+    if h.channel == nil || h.cancelled {
+        return nil
+    }
+
+    // the new count is applied by consume
+    h.cancelled = true
+
+    return h.channel.Cancel(h.tag, false)
+}
+
+// Prefetch returns the prefetch count and whether it is global.
+func (h *AmqpProducerHandler) Prefetch() (int, bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.prefetch, h.prefetchGlobal
+}
+
+// applyQos must be called with h.mu held. The other mode is reset to no
+// limit, the per consumer count only applies to consumers started
+// afterwards.
+func (h *AmqpProducerHandler) applyQos(channel IAmqpChannel) error {
+    if !h.prefetchSet {
+        return nil
+    }
+
+    consumerCount, globalCount := h.prefetch, 0
+
+    if h.prefetchGlobal {
+        consumerCount, globalCount = 0, h.prefetch
+    }
+
+    if err := channel.Qos(consumerCount, 0, false); err != nil {
+        return err
+    }
+
+    return channel.Qos(globalCount, 0, true)
+}
+
+// consume applies the prefetch count and starts a consumer on channel.
+func (h *AmqpProducerHandler) consume(channel IAmqpChannel) (<- chan amqp.Delivery, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.channel = nil
+
+    if err := h.applyQos(channel); err != nil {
+        return nil, err
+    }
+
+    h.consumes++
+    tag := fmt.Sprintf("%s.%d", h.queue, h.consumes)
+
+    deliveries, err := channel.Consume(h.queue, tag, false, false, false, false, h.args)
+
+    if err != nil {
+        return nil, err
+    }
+
+    h.channel = channel
+    h.tag = tag
+    h.cancelled = false
+
+    return deliveries, nil
+}
+
+// resubscribe reports whether the deliveries of channel ended because of
+// SetPrefetch.
+func (h *AmqpProducerHandler) resubscribe(channel IAmqpChannel) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    if h.channel != channel || !h.cancelled {
+        h.channel = nil
+        return false
+    }
+
+    return true
+}
+
+func (h *AmqpProducerHandler) Enqueue(chanQueue chan <- interface{}) {
+    defer close(h.stopWait)
+
+    for {
+        var deliveries <- chan amqp.Delivery
+
+        channel, gen, err := h.client.channelGen()
+
+        if err == nil {
+            deliveries, err = h.consume(channel)
+            if err != nil {
+                channel.Close()
+            }
+        }
+
+        if errors.Is(err, ErrClientFailed) || errors.Is(err, ErrClientClosed) {
+            <- h.stop
+            return
+        }
+
+        if err != nil {
+            h.client.log().Errorf("AmqpProducerHandler consume %s error: %#v", h.queue, err)
+            select {
+            case <- h.client.waitReconnect(gen):
+                continue
+            case <- h.stop:
+                return
+            }
+        }
+
+        if !h.enqueueDeliveries(channel, deliveries, chanQueue) {
+            return
+        }
+    }
+}
+
+// enqueueDeliveries returns false when the handler is stopped and true when
+// the deliveries channel is closed, which means the channel has to be
+// opened again. A consumer cancelled by SetPrefetch is started again on
+// the same channel.
+func (h *AmqpProducerHandler) enqueueDeliveries(channel IAmqpChannel, deliveries <- chan amqp.Delivery, chanQueue chan <- interface{}) bool {
+    for {
+        select {
+        case delivery, ok := <- deliveries:
+            if !ok {
+                if !h.resubscribe(channel) {
+                    return true
+                }
+                var err error
+                if deliveries, err = h.consume(channel); err != nil {
+                    h.client.log().Errorf("AmqpProducerHandler consume %s error: %#v", h.queue, err)
+                    channel.Close()
+                    return true
+                }
+                continue
+            }
+            select {
+            case chanQueue <- delivery:
+            case <- h.stop:
+                channel.Close()
+                return false
+            }
+        case <- h.stop:
+            channel.Close()
+            return false
+        }
+    }
+}
+
+func (h *AmqpProducerHandler) Stop() {
+    close(h.stop)
+    <- h.stopWait
+    h.client = nil
+    h.stop = nil
+    h.stopWait = nil
+}
+
+
+// NewAmqpDeliveryHandler adapts handler to the worker.Consumer handler. The
+// delivery is acked when handler returns nil and nacked otherwise.
+func NewAmqpDeliveryHandler(handler func(amqp.Delivery) error, requeue bool) func(interface{}) {
+    return func(item interface{}) {
+        delivery, ok := item.(amqp.Delivery)
+
+        if !ok {
+            return
+        }
+
+        if err := handler(delivery); err != nil {
+            delivery.Nack(false, requeue)
+        } else {
+            delivery.Ack(false)
+        }
+    }
+}
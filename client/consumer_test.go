@@ -0,0 +1,204 @@
+package client
+
+import (
+    "time"
+    "errors"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txWorker "github.com/serenity-77/bagudung/worker"
+)
+
+
+func TestAmqpProducerHandlerEnqueue(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    handler := NewAmqpProducerHandler(client, "queue_test", nil)
+    chanQueue := make(chan interface{}, 10)
+
+    go handler.Enqueue(chanQueue)
+
+    channel := conn.WaitChannel()
+    assert.Equal(t, "queue_test", channel.WaitConsume())
+
+    channel.Deliver("hello")
+
+    delivery := (<- chanQueue).(amqp.Delivery)
+    assert.Equal(t, []byte("hello"), delivery.Body)
+    assert.Equal(t, uint64(1), delivery.DeliveryTag)
+
+    handler.Stop()
+
+    assert.True(t, channel.closed)
+    assert.Nil(t, handler.client)
+    assert.Nil(t, handler.stop)
+    assert.Nil(t, handler.stopWait)
+}
+
+func TestAmqpProducerHandlerPrefetch(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    consumer := txWorker.NewConsumer(func(interface{}) {}, 3)
+    handler := NewAmqpProducerHandler(client, "queue_test", nil, WithConsumerPrefetch(consumer, false))
+    chanQueue := make(chan interface{}, 10)
+
+    go handler.Enqueue(chanQueue)
+
+    channel := conn.WaitChannel()
+    assert.Equal(t, "queue_test", channel.WaitConsume())
+    assert.Equal(t, []fakeQos{{3, false}, {0, true}}, channel.QosCalls())
+
+    assert.Nil(t, handler.SetPrefetch(5, true))
+    assert.Equal(t, "queue_test", channel.WaitConsume())
+    assert.Equal(t, []fakeQos{{3, false}, {0, true}, {0, false}, {5, true}}, channel.QosCalls())
+
+    count, global := handler.Prefetch()
+    assert.Equal(t, 5, count)
+    assert.True(t, global)
+
+    handler.Stop()
+}
+
+func TestAmqpProducerHandlerSetPrefetch(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs"}},
+    }))
+
+    for i := 0; i < 3; i++ {
+        broker.Publish("", "jobs", amqp.Publishing{})
+    }
+
+    handler := NewAmqpProducerHandler(client, "jobs", nil, WithPrefetch(1, false))
+    chanQueue := make(chan interface{}, 10)
+
+    go handler.Enqueue(chanQueue)
+
+    first := (<- chanQueue).(amqp.Delivery)
+
+    assert.Equal(t, 1, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 2, broker.QueueMessages("jobs"))
+
+    assert.Nil(t, handler.SetPrefetch(3, false))
+
+    second := (<- chanQueue).(amqp.Delivery)
+    third := (<- chanQueue).(amqp.Delivery)
+
+    assert.False(t, second.Redelivered)
+    assert.False(t, third.Redelivered)
+    assert.Equal(t, 3, broker.QueueUnacked("jobs"))
+
+    // the delivery of the cancelled consumer is still acked on the channel
+    assert.Nil(t, first.Ack(false))
+    assert.Nil(t, third.Ack(true))
+    assert.Equal(t, 0, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 1, broker.QueueConsumers("jobs"))
+
+    handler.Stop()
+    client.Disconnect()
+}
+
+func TestAmqpProducerHandlerResubscribe(t *testing.T) {
+    conns := make(chan *FakeAmqpConnection, 10)
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        conn := NewFakeAmqpConnection()
+        conns <- conn
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    conn := <- conns
+    conn.WaitNotifyClose()
+
+    handler := NewAmqpProducerHandler(client, "queue_test", nil)
+    chanQueue := make(chan interface{}, 10)
+
+    go handler.Enqueue(chanQueue)
+
+    channel := conn.WaitChannel()
+    channel.WaitConsume()
+
+    conn.TriggerClose(&amqp.Error{
+        Code:       302,
+        Reason:     "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+        Server:     true,
+        Recover:    false,
+    })
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(2 * time.Second)
+
+    newConn := <- conns
+    newConn.WaitNotifyClose()
+
+    newChannel := newConn.WaitChannel()
+    assert.Equal(t, "queue_test", newChannel.WaitConsume())
+
+    newChannel.Deliver("after reconnect")
+
+    delivery := (<- chanQueue).(amqp.Delivery)
+    assert.Equal(t, []byte("after reconnect"), delivery.Body)
+
+    handler.Stop()
+}
+
+func TestAmqpProducerHandlerStopWhileEnqueue(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    handler := NewAmqpProducerHandler(client, "queue_test", nil)
+
+    // nobody reads from chanQueue
+    go handler.Enqueue(make(chan interface{}))
+
+    channel := conn.WaitChannel()
+    channel.WaitConsume()
+    channel.Deliver("hello")
+
+    handler.Stop()
+
+    assert.True(t, channel.closed)
+}
+
+func TestAmqpProducerHandlerWorker(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    handleError := errors.New("handle error")
+
+    deliveryHandler := NewAmqpDeliveryHandler(func(delivery amqp.Delivery) error {
+        if string(delivery.Body) == "fail" {
+            return handleError
+        }
+        return nil
+    }, true)
+
+    worker := txWorker.NewWorker(
+        txWorker.NewProducer(NewAmqpProducerHandler(client, "queue_test", nil)),
+        txWorker.NewConsumer(deliveryHandler, 2),
+    )
+
+    channel := conn.WaitChannel()
+    channel.WaitConsume()
+
+    tag := channel.Deliver("ok")
+    assert.Equal(t, fakeAck{tag, true, false}, channel.WaitAck())
+
+    tag = channel.Deliver("fail")
+    assert.Equal(t, fakeAck{tag, false, true}, channel.WaitAck())
+
+    worker.Stop()
+}
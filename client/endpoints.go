@@ -0,0 +1,88 @@
+package client
+
+import (
+    _mathRand "math/rand"
+)
+
+
+var (
+    _endpointPermFunc = _mathRand.Perm
+)
+
+// EndpointSelection is the order in which AmqpClient tries its endpoints on
+// every connect.
+type EndpointSelection int
+
+const (
+    // SelectRoundRobin starts with the endpoint after the one connected last.
+    SelectRoundRobin EndpointSelection = iota
+    // SelectRandom tries the endpoints in random order.
+    SelectRandom
+    // SelectPriority always starts with the dial url. The client goes back
+    // to the preferred node on the next reconnect only, it stays on a
+    // working fallback node until that connection is lost.
+    SelectPriority
+)
+
+// WithEndpoints adds fallback urls after the dial url. A connect tries
+// every endpoint once in selection order and stops at the first one which
+// connects, the error of the last one is returned when none does.
+func WithEndpoints(selection EndpointSelection, urls ...string) AmqpClientOption {
+    return func(c *AmqpClient) {
+        c.endpoints = append(c.endpoints, urls...)
+        c.selection = selection
+    }
+}
+
+// CurrentEndpoint returns the url of the current connection.
+func (c *AmqpClient) CurrentEndpoint() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.currentUrl
+}
+
+func (c *AmqpClient) Endpoints() []string {
+    return append([]string{}, c.endpoints...)
+}
+
+func (c *AmqpClient) endpointOrder() []int {
+    n := len(c.endpoints)
+
+    if c.selection == SelectRandom {
+        return _endpointPermFunc(n)
+    }
+
+    order := make([]int, n)
+
+    for i := range order {
+        if c.selection == SelectPriority {
+            order[i] = i
+        } else {
+            order[i] = (c.nextEndpoint + i) % n
+        }
+    }
+
+    return order
+}
+
+// dialEndpoints returns the connection and the index of the endpoint it
+// was made to.
+func (c *AmqpClient) dialEndpoints() (IAmqpConnection, int, error) {
+    var lastErr error
+
+    for _, i := range c.endpointOrder() {
+        conn, err := c.dialFunc(c.endpoints[i], c.dialConfig)
+
+        if err == nil {
+            return conn, i, nil
+        }
+
+        if len(c.endpoints) > 1 {
+            c.log().Errorf("AmqpClient endpoint %d dial error: %#v", i, err)
+        }
+
+        lastErr = err
+    }
+
+    return nil, -1, lastErr
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+    "sync"
+    "time"
+    "sync/atomic"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+type AmqpEventType int
+
+const (
+    EventConnected AmqpEventType = iota
+    EventDisconnected
+    EventReconnectAttempt
+    EventReconnectFailed
+    EventFailed
+    EventClosed
+    EventTopologyFailed
+    EventBlocked
+    EventUnblocked
+)
+
+func (t AmqpEventType) String() string {
+    switch t {
+    case EventConnected:
+        return "Connected"
+    case EventDisconnected:
+        return "Disconnected"
+    case EventReconnectAttempt:
+        return "ReconnectAttempt"
+    case EventReconnectFailed:
+        return "ReconnectFailed"
+    case EventFailed:
+        return "Failed"
+    case EventClosed:
+        return "Closed"
+    case EventTopologyFailed:
+        return "TopologyFailed"
+    case EventBlocked:
+        return "Blocked"
+    case EventUnblocked:
+        return "Unblocked"
+    }
+    return "Unknown"
+}
+
+// AmqpEvent describes a change of the AmqpClient connection.
+//
+//  Connected           the client reconnected to Endpoint after Attempt attempts
+//  Disconnected        the connection was lost because of Reason
+//  ReconnectAttempt    attempt number Attempt is made after Delay
+//  ReconnectFailed     attempt number Attempt failed with Err
+//  Failed              the reconnect policy gave up, Err is the last error
+//  Closed              Disconnect was called, no more events are sent
+//  TopologyFailed      declaring the topology after reconnecting failed with Err
+//  Blocked             the broker blocked the connection, Err is a *BlockedError
+//  Unblocked           the broker unblocked the connection or it was replaced
+type AmqpEvent struct {
+    Type        AmqpEventType
+    Reason      *amqp.Error
+    Attempt     int
+    Delay       time.Duration
+    Err         error
+    Endpoint    string
+}
+
+// eventBufferSize is the number of events held for a receiver which is
+// not drained, the events after that are dropped.
+const eventBufferSize = 1024
+
+// NotifyEvent registers a listener for connection events. Every receiver
+// gets the events in order from a goroutine of its own, so a slow receiver
+// does not hold up the client. Events a receiver falls more than
+// eventBufferSize behind on are dropped and counted in DroppedEvents. The
+// receiver is closed after the Closed event.
+func (c *AmqpClient) NotifyEvent(receiver chan AmqpEvent) chan AmqpEvent {
+    c.eventMu.Lock()
+    defer c.eventMu.Unlock()
+
+    if c.eventsClosed {
+        close(receiver)
+    } else {
+        subscriber := &eventSubscriber{
+            receiver:   receiver,
+            wake:       make(chan struct{}, 1),
+        }
+        c.eventReceivers = append(c.eventReceivers, subscriber)
+        go subscriber.forwardLoop()
+    }
+
+    return receiver
+}
+
+// DroppedEvents returns the number of events dropped for receivers which
+// fell behind.
+func (c *AmqpClient) DroppedEvents() uint64 {
+    return atomic.LoadUint64(&c.eventsDropped)
+}
+
+func (c *AmqpClient) emit(event AmqpEvent) {
+    c.eventMu.Lock()
+    defer c.eventMu.Unlock()
+
+    for _, subscriber := range c.eventReceivers {
+        if !subscriber.push(event, false) {
+            atomic.AddUint64(&c.eventsDropped, 1)
+        }
+    }
+}
+
+func (c *AmqpClient) closeEvents() {
+    c.eventMu.Lock()
+    defer c.eventMu.Unlock()
+
+    for _, subscriber := range c.eventReceivers {
+        subscriber.push(AmqpEvent{Type: EventClosed}, true)
+    }
+
+    c.eventReceivers = nil
+    c.eventsClosed = true
+}
+
+
+type eventSubscriber struct {
+    receiver    chan AmqpEvent
+    mu          sync.Mutex
+    pending     []AmqpEvent
+    closed      bool
+    wake        chan struct{}
+}
+
+// push queues event for the receiver, the last one closes it. It returns
+// false when the event is dropped.
+func (s *eventSubscriber) push(event AmqpEvent, last bool) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if !last && len(s.pending) >= eventBufferSize {
+        return false
+    }
+
+    s.pending = append(s.pending, event)
+    s.closed = last
+
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+
+    return true
+}
+
+func (s *eventSubscriber) forwardLoop() {
+    for {
+        s.mu.Lock()
+
+        if len(s.pending) == 0 {
+            closed := s.closed
+            s.mu.Unlock()
+
+            if closed {
+                close(s.receiver)
+                return
+            }
+
+            <- s.wake
+            continue
+        }
+
+        event := s.pending[0]
+        s.pending = s.pending[1:]
+        s.mu.Unlock()
+
+        s.receiver <- event
+    }
+}
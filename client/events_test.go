@@ -0,0 +1,145 @@
+package client
+
+import (
+    "time"
+    "testing"
+    "sync/atomic"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+func TestAmqpEventTypeString(t *testing.T) {
+    assert.Equal(t, "Connected", EventConnected.String())
+    assert.Equal(t, "Disconnected", EventDisconnected.String())
+    assert.Equal(t, "ReconnectAttempt", EventReconnectAttempt.String())
+    assert.Equal(t, "ReconnectFailed", EventReconnectFailed.String())
+    assert.Equal(t, "Failed", EventFailed.String())
+    assert.Equal(t, "Closed", EventClosed.String())
+    assert.Equal(t, "Unknown", AmqpEventType(100).String())
+}
+
+func TestAmqpClientEvents(t *testing.T) {
+    var reconnectError int32
+
+    dialError := &connectError{}
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        if atomic.LoadInt32(&reconnectError) == 0 {
+            return FakeAmqpDialFunc(dialUrl, dialConfig)
+        } else {
+            return nil, dialError
+        }
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    atomic.StoreInt32(&reconnectError, 1)
+
+    reason := &amqp.Error{
+        Code:       302,
+        Reason:     "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+        Server:     true,
+        Recover:    false,
+    }
+
+    conn.TriggerClose(reason)
+
+    assert.Equal(t, AmqpEvent{Type: EventDisconnected, Reason: reason}, <- events)
+    assert.Equal(t, AmqpEvent{Type: EventReconnectAttempt, Attempt: 1, Delay: 2 * time.Second}, <- events)
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(2 * time.Second)
+
+    assert.Equal(t, AmqpEvent{Type: EventReconnectFailed, Attempt: 1, Err: dialError}, <- events)
+    assert.Equal(t, AmqpEvent{Type: EventReconnectAttempt, Attempt: 2, Delay: 4 * time.Second}, <- events)
+
+    atomic.StoreInt32(&reconnectError, 0)
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(4 * time.Second)
+
+    assert.Equal(t, AmqpEvent{Type: EventConnected, Attempt: 2, Endpoint: _DIAL_URL_TEST}, <- events)
+
+    client.conn.(*FakeAmqpConnection).WaitNotifyClose()
+
+    client.Disconnect()
+
+    assert.Equal(t, AmqpEvent{Type: EventClosed}, <- events)
+
+    _, ok := <- events
+    assert.False(t, ok)
+
+    _, ok = <- client.NotifyEvent(make(chan AmqpEvent))
+    assert.False(t, ok)
+}
+
+func TestAmqpClientEventFailed(t *testing.T) {
+    var reconnectError int32
+
+    dialError := &connectError{}
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        if atomic.LoadInt32(&reconnectError) == 0 {
+            return FakeAmqpDialFunc(dialUrl, dialConfig)
+        } else {
+            return nil, dialError
+        }
+    }
+
+    policy := NewLimitedReconnectPolicy(NewConstantReconnectPolicy(time.Second), 1, 0)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil, WithReconnectPolicy(policy))
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    atomic.StoreInt32(&reconnectError, 1)
+
+    triggerForcedClose(conn)
+
+    assert.Equal(t, EventDisconnected, (<- events).Type)
+    assert.Equal(t, EventReconnectAttempt, (<- events).Type)
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(time.Second)
+
+    assert.Equal(t, EventReconnectFailed, (<- events).Type)
+    assert.Equal(t, AmqpEvent{Type: EventFailed, Err: dialError}, <- events)
+
+    client.Disconnect()
+
+    assert.Equal(t, EventClosed, (<- events).Type)
+}
+
+func TestAmqpClientEventsStalledReceiver(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+    client.conn.(*FakeAmqpConnection).WaitNotifyClose()
+
+    // nobody reads this one until the client is gone
+    stalled := client.NotifyEvent(make(chan AmqpEvent))
+
+    for i := 0; i < eventBufferSize + 10; i++ {
+        client.emit(AmqpEvent{Type: EventUnblocked, Attempt: i})
+    }
+
+    // one may be held by the goroutine sending it
+    assert.GreaterOrEqual(t, client.DroppedEvents(), uint64(9))
+    assert.LessOrEqual(t, client.DroppedEvents(), uint64(10))
+
+    client.Disconnect()
+
+    assert.Equal(t, AmqpEvent{Type: EventUnblocked, Attempt: 0}, <- stalled)
+
+    var last AmqpEvent
+    for last = range stalled {
+    }
+    assert.Equal(t, AmqpEvent{Type: EventClosed}, last)
+}
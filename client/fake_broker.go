@@ -0,0 +1,1090 @@
+package client
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+var (
+    ErrFakeBrokerDown = errors.New("fake broker: connection refused")
+)
+
+var _ IAmqpConnection       = (*FakeBrokerConnection)(nil)
+var _ IAmqpChannel          = (*FakeBrokerChannel)(nil)
+var _ amqp.Acknowledger     = (*FakeBrokerChannel)(nil)
+
+// FakeBroker is an in-process broker for tests. Its Dial method is an
+// AmqpDialFunc, connections use the broker clock so reconnects can be
+// driven with utils.FakeClock.
+//
+// Only the default exchange and direct, fanout and topic exchanges are
+// routed, direct reply-to and basic.qos prefetch counts are supported.
+// Messages of queues with a x-message-ttl argument are dead lettered by
+// Expire. Deliveries nacked or rejected without requeue are dead lettered
+// when the queue has a x-dead-letter-exchange argument.
+type FakeBroker struct {
+    mu          sync.Mutex
+    clock       txUtils.IClock
+    exchanges   map[string]*fakeExchange
+    queues      map[string]*fakeQueue
+    conns       map[*FakeBrokerConnection]struct{}
+    down        bool
+    seq         uint64
+}
+
+type fakeExchange struct {
+    name        string
+    kind        string
+    bindings    []fakeBinding
+}
+
+type fakeBinding struct {
+    queue       string
+    key         string
+}
+
+type fakeQueue struct {
+    name        string
+    autoDelete  bool
+    owner       *FakeBrokerConnection
+    args        amqp.Table
+    messages    []*fakeMessage
+    consumers   []*fakeConsumer
+    next        int
+    unacked     int
+}
+
+type fakeMessage struct {
+    exchange    string
+    key         string
+    msg         amqp.Publishing
+    redelivered bool
+    expiresAt   time.Time
+}
+
+type fakeConsumer struct {
+    tag         string
+    queue       *fakeQueue
+    channel     *FakeBrokerChannel
+    autoAck     bool
+    prefetch    int
+    unacked     int
+    deliveries  chan amqp.Delivery
+}
+
+type fakeUnacked struct {
+    tag         uint64
+    queue       *fakeQueue
+    consumer    *fakeConsumer
+    message     *fakeMessage
+}
+
+func NewFakeBroker(clock txUtils.IClock) *FakeBroker {
+    if clock == nil {
+        clock = txUtils.NewFakeClock()
+    }
+
+    broker := &FakeBroker{
+        clock:      clock,
+        exchanges:  make(map[string]*fakeExchange),
+        queues:     make(map[string]*fakeQueue),
+        conns:      make(map[*FakeBrokerConnection]struct{}),
+    }
+
+    for _, kind := range []string{amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic} {
+        broker.exchanges["amq." + kind] = &fakeExchange{name: "amq." + kind, kind: kind}
+    }
+
+    return broker
+}
+
+func (b *FakeBroker) Clock() txUtils.IClock {
+    return b.clock
+}
+
+// Dial opens a new connection, it fails with ErrFakeBrokerDown while the
+// broker is down.
+func (b *FakeBroker) Dial(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.down {
+        return nil, ErrFakeBrokerDown
+    }
+
+    conn := &FakeBrokerConnection{
+        broker:     b,
+        channels:   make(map[*FakeBrokerChannel]struct{}),
+    }
+
+    b.conns[conn] = struct{}{}
+
+    return conn, nil
+}
+
+// SetDown makes new dials fail, existing connections are not affected.
+func (b *FakeBroker) SetDown(down bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.down = down
+}
+
+// DropConnections closes every connection with reason, a nil reason is
+// reported as a forced connection close.
+func (b *FakeBroker) DropConnections(reason *amqp.Error) {
+    if reason == nil {
+        reason = &amqp.Error{
+            Code:       amqp.ConnectionForced,
+            Reason:     "CONNECTION_FORCED - broker forced connection closure",
+            Server:     true,
+        }
+    }
+
+    b.mu.Lock()
+    conns := make([]*FakeBrokerConnection, 0, len(b.conns))
+    for conn := range b.conns {
+        conns = append(conns, conn)
+    }
+    b.mu.Unlock()
+
+    for _, conn := range conns {
+        conn.shutdown(reason)
+    }
+}
+
+// SetBlocked sends connection.blocked, or connection.unblocked when active
+// is false, to the open connections like a broker resource alarm does.
+// Listeners are sent to synchronously and have to be drained.
+func (b *FakeBroker) SetBlocked(active bool, reason string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    for conn := range b.conns {
+        for _, receiver := range conn.blocks {
+            receiver <- amqp.Blocking{Active: active, Reason: reason}
+        }
+    }
+}
+
+func (b *FakeBroker) Connections() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return len(b.conns)
+}
+
+// Publish routes msg as if it was published by a client.
+func (b *FakeBroker) Publish(exchange, key string, msg amqp.Publishing) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if !b.route(&fakeMessage{exchange: exchange, key: key, msg: msg}) {
+        return fmt.Errorf("fake broker: no exchange %q", exchange)
+    }
+
+    return nil
+}
+
+// QueueMessages returns the number of messages ready for delivery.
+func (b *FakeBroker) QueueMessages(name string) int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if queue, ok := b.queues[name]; ok {
+        return len(queue.messages)
+    }
+    return 0
+}
+
+// QueueUnacked returns the number of delivered but unacknowledged messages.
+func (b *FakeBroker) QueueUnacked(name string) int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if queue, ok := b.queues[name]; ok {
+        return queue.unacked
+    }
+    return 0
+}
+
+func (b *FakeBroker) QueueConsumers(name string) int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if queue, ok := b.queues[name]; ok {
+        return len(queue.consumers)
+    }
+    return 0
+}
+
+func (b *FakeBroker) HasQueue(name string) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    _, ok := b.queues[name]
+    return ok
+}
+
+func (b *FakeBroker) HasExchange(name string) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    _, ok := b.exchanges[name]
+    return ok
+}
+
+// Expire dead letters the messages whose queue ttl has passed on the broker
+// clock, call it after advancing the clock.
+func (b *FakeBroker) Expire() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    now := b.clock.Now()
+
+    for _, queue := range b.queues {
+        for len(queue.messages) > 0 {
+            message := queue.messages[0]
+            if message.expiresAt.IsZero() || message.expiresAt.After(now) {
+                break
+            }
+            queue.messages = queue.messages[1:]
+            b.deadLetter(queue, message)
+        }
+    }
+}
+
+func (b *FakeBroker) nextName(prefix string) string {
+    b.seq++
+    return fmt.Sprintf("%s%d", prefix, b.seq)
+}
+
+// route delivers message to the bound queues, it returns false when the
+// exchange does not exist. Must be called with b.mu held.
+func (b *FakeBroker) route(message *fakeMessage) bool {
+    var names []string
+
+    if message.exchange == "" {
+        names = []string{message.key}
+    } else {
+        exchange, ok := b.exchanges[message.exchange]
+        if !ok {
+            return false
+        }
+        for _, binding := range exchange.bindings {
+            if exchange.matches(binding.key, message.key) {
+                names = append(names, binding.queue)
+            }
+        }
+    }
+
+    routed := make(map[string]bool)
+
+    for _, name := range names {
+        queue, ok := b.queues[name]
+        if !ok || routed[name] {
+            continue
+        }
+        routed[name] = true
+        copied := *message
+        copied.expiresAt = time.Time{}
+        if ttl, ok := tableInt(queue.args["x-message-ttl"]); ok {
+            copied.expiresAt = b.clock.Now().Add(time.Duration(ttl) * time.Millisecond)
+        }
+        queue.messages = append(queue.messages, &copied)
+        b.dispatch(queue)
+    }
+
+    return true
+}
+
+func (e *fakeExchange) matches(bindingKey, routingKey string) bool {
+    switch e.kind {
+    case amqp.ExchangeFanout:
+        return true
+    case amqp.ExchangeTopic:
+        return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+    }
+    return bindingKey == routingKey
+}
+
+func topicMatches(pattern, words []string) bool {
+    if len(pattern) == 0 {
+        return len(words) == 0
+    }
+
+    switch pattern[0] {
+    case "#":
+        for i := 0; i <= len(words); i++ {
+            if topicMatches(pattern[1:], words[i:]) {
+                return true
+            }
+        }
+        return false
+    case "*":
+        return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+    }
+
+    return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+}
+
+// dispatch hands ready messages round robin to the queue consumers which
+// are below their prefetch count.
+func (b *FakeBroker) dispatch(queue *fakeQueue) {
+    for len(queue.messages) > 0 {
+        consumer := queue.nextConsumer()
+
+        if consumer == nil {
+            return
+        }
+
+        message := queue.messages[0]
+        queue.messages = queue.messages[1:]
+
+        consumer.deliver(message)
+    }
+}
+
+func (q *fakeQueue) nextConsumer() *fakeConsumer {
+    for i := 0; i < len(q.consumers); i++ {
+        consumer := q.consumers[q.next % len(q.consumers)]
+        q.next++
+        if consumer.ready() {
+            return consumer
+        }
+    }
+    return nil
+}
+
+// ready reports whether the per consumer and the channel prefetch counts
+// allow another delivery.
+func (c *fakeConsumer) ready() bool {
+    if c.autoAck {
+        return true
+    }
+    if c.prefetch > 0 && c.unacked >= c.prefetch {
+        return false
+    }
+    return c.channel.prefetch == 0 || len(c.channel.unacked) < c.channel.prefetch
+}
+
+func (b *FakeBroker) deadLetter(queue *fakeQueue, message *fakeMessage) {
+    exchange, ok := queue.args["x-dead-letter-exchange"].(string)
+
+    if !ok {
+        return
+    }
+
+    dead := &fakeMessage{exchange: exchange, key: message.key, msg: message.msg}
+
+    if key, ok := queue.args["x-dead-letter-routing-key"].(string); ok {
+        dead.key = key
+    }
+
+    b.route(dead)
+}
+
+func (b *FakeBroker) deleteQueue(queue *fakeQueue) {
+    delete(b.queues, queue.name)
+
+    for _, exchange := range b.exchanges {
+        bindings := exchange.bindings[:0]
+        for _, binding := range exchange.bindings {
+            if binding.queue != queue.name {
+                bindings = append(bindings, binding)
+            }
+        }
+        exchange.bindings = bindings
+    }
+}
+
+
+type FakeBrokerConnection struct {
+    broker      *FakeBroker
+    closed      bool
+    closes      []chan *amqp.Error
+    blocks      []chan amqp.Blocking
+    channels    map[*FakeBrokerChannel]struct{}
+}
+
+func (conn *FakeBrokerConnection) Channel() (IAmqpChannel, error) {
+    b := conn.broker
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if conn.closed {
+        return nil, amqp.ErrClosed
+    }
+
+    channel := &FakeBrokerChannel{
+        conn:       conn,
+        unacked:    make(map[uint64]*fakeUnacked),
+        consumers:  make(map[string]*fakeConsumer),
+        done:       make(chan struct{}),
+        mailbox:    newFakeMailbox(),
+    }
+
+    conn.channels[channel] = struct{}{}
+
+    return channel, nil
+}
+
+func (conn *FakeBrokerConnection) Close() error {
+    if !conn.shutdown(nil) {
+        return amqp.ErrClosed
+    }
+    return nil
+}
+
+func (conn *FakeBrokerConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+    b := conn.broker
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if conn.closed {
+        close(receiver)
+    } else {
+        conn.closes = append(conn.closes, receiver)
+    }
+
+    return receiver
+}
+
+func (conn *FakeBrokerConnection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+    b := conn.broker
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if conn.closed {
+        close(receiver)
+    } else {
+        conn.blocks = append(conn.blocks, receiver)
+    }
+
+    return receiver
+}
+
+func (conn *FakeBrokerConnection) GetClock() txUtils.IClock {
+    return conn.broker.clock
+}
+
+func (conn *FakeBrokerConnection) shutdown(reason *amqp.Error) bool {
+    b := conn.broker
+
+    b.mu.Lock()
+
+    if conn.closed {
+        b.mu.Unlock()
+        return false
+    }
+
+    conn.closed = true
+    delete(b.conns, conn)
+
+    for channel := range conn.channels {
+        channel.shutdown(reason)
+    }
+
+    for _, queue := range b.queues {
+        if queue.owner == conn {
+            b.deleteQueue(queue)
+        }
+    }
+
+    closes := conn.closes
+    conn.closes = nil
+
+    for _, receiver := range conn.blocks {
+        close(receiver)
+    }
+    conn.blocks = nil
+
+    b.mu.Unlock()
+
+    if reason != nil {
+        for _, receiver := range closes {
+            receiver <- reason
+        }
+    }
+
+    for _, receiver := range closes {
+        close(receiver)
+    }
+
+    return true
+}
+
+
+type FakeBrokerChannel struct {
+    conn                *FakeBrokerConnection
+    closed              bool
+    confirming          bool
+    publishSeq          uint64
+    deliveryTag         uint64
+    unacked             map[uint64]*fakeUnacked
+    consumers           map[string]*fakeConsumer
+    confirms            []chan amqp.Confirmation
+    closes              []chan *amqp.Error
+    done                chan struct{}
+    mailbox             *fakeMailbox
+    replyTo             string
+    prefetch            int
+    consumerPrefetch    int
+}
+
+func channelException(code int, reason string) *amqp.Error {
+    return &amqp.Error{Code: code, Reason: reason, Server: true, Recover: true}
+}
+
+// exception closes the channel like the broker does on a channel level
+// error. Must be called with b.mu held.
+func (ch *FakeBrokerChannel) exception(code int, reason string) error {
+    err := channelException(code, reason)
+    ch.shutdown(err)
+    return err
+}
+
+func (ch *FakeBrokerChannel) lock() (*FakeBroker, error) {
+    b := ch.conn.broker
+    b.mu.Lock()
+    if ch.closed {
+        b.mu.Unlock()
+        return nil, amqp.ErrClosed
+    }
+    return b, nil
+}
+
+func (ch *FakeBrokerChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    if exchange, ok := b.exchanges[name]; ok {
+        if exchange.kind != kind {
+            return ch.exception(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name))
+        }
+        return nil
+    }
+
+    switch kind {
+    case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+    default:
+        return ch.exception(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unsupported exchange type '%s'", kind))
+    }
+
+    b.exchanges[name] = &fakeExchange{name: name, kind: kind}
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+    b, err := ch.lock()
+    if err != nil {
+        return amqp.Queue{}, err
+    }
+    defer b.mu.Unlock()
+
+    if name == "" {
+        name = b.nextName("amq.gen-")
+    }
+
+    queue, ok := b.queues[name]
+
+    if ok && queue.owner != nil && queue.owner != ch.conn {
+        return amqp.Queue{}, ch.exception(amqp.ResourceLocked, fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name))
+    }
+
+    if !ok {
+        queue = &fakeQueue{
+            name:       name,
+            autoDelete: autoDelete,
+            args:       args,
+        }
+        if exclusive {
+            queue.owner = ch.conn
+        }
+        b.queues[name] = queue
+    }
+
+    return amqp.Queue{Name: name, Messages: len(queue.messages), Consumers: len(queue.consumers)}, nil
+}
+
+func (ch *FakeBrokerChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    target, ok := b.exchanges[exchange]
+
+    if !ok {
+        return ch.exception(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+    }
+
+    if _, ok := b.queues[name]; !ok {
+        return ch.exception(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", name))
+    }
+
+    for _, binding := range target.bindings {
+        if binding.queue == name && binding.key == key {
+            return nil
+        }
+    }
+
+    target.bindings = append(target.bindings, fakeBinding{name, key})
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) Confirm(noWait bool) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+    ch.confirming = true
+    return nil
+}
+
+func (ch *FakeBrokerChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+    b := ch.conn.broker
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if ch.closed {
+        close(confirm)
+    } else {
+        ch.confirms = append(ch.confirms, confirm)
+    }
+
+    return confirm
+}
+
+func (ch *FakeBrokerChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+    b := ch.conn.broker
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if ch.closed {
+        close(receiver)
+    } else {
+        ch.closes = append(ch.closes, receiver)
+    }
+
+    return receiver
+}
+
+func (ch *FakeBrokerChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    if msg.ReplyTo == DirectReplyTo {
+        if ch.replyTo == "" {
+            return ch.exception(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+        }
+        msg.ReplyTo = ch.replyTo
+    }
+
+    if !b.route(&fakeMessage{exchange: exchange, key: key, msg: msg}) {
+        // like the broker, the publish succeeds and the channel is closed afterwards
+        ch.exception(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange))
+        return nil
+    }
+
+    if ch.confirming {
+        ch.publishSeq++
+        confirmation := amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: true}
+        confirms := ch.confirms
+        ch.mailbox.post(func() {
+            for _, confirm := range confirms {
+                confirm <- confirmation
+            }
+        })
+    }
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<- chan amqp.Delivery, error) {
+    b, err := ch.lock()
+    if err != nil {
+        return nil, err
+    }
+    defer b.mu.Unlock()
+
+    if queue == DirectReplyTo {
+        return ch.consumeReplies(consumer, autoAck)
+    }
+
+    target, ok := b.queues[queue]
+
+    if !ok {
+        return nil, ch.exception(amqp.NotFound, fmt.Sprintf("NOT_FOUND - no queue '%s'", queue))
+    }
+
+    if consumer == "" {
+        consumer = b.nextName("ctag-")
+    }
+
+    c := &fakeConsumer{
+        tag:        consumer,
+        queue:      target,
+        channel:    ch,
+        autoAck:    autoAck,
+        prefetch:   ch.consumerPrefetch,
+        deliveries: make(chan amqp.Delivery),
+    }
+
+    ch.consumers[consumer] = c
+    target.consumers = append(target.consumers, c)
+
+    b.dispatch(target)
+
+    return c.deliveries, nil
+}
+
+// consumeReplies backs direct reply-to with an auto delete queue named
+// after the pseudo queue, publishings with ReplyTo set to DirectReplyTo get
+// its name. Must be called with b.mu held.
+func (ch *FakeBrokerChannel) consumeReplies(consumer string, autoAck bool) (<- chan amqp.Delivery, error) {
+    b := ch.conn.broker
+
+    if !autoAck {
+        return nil, ch.exception(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge")
+    }
+
+    if ch.replyTo != "" {
+        return nil, ch.exception(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer already set")
+    }
+
+    if consumer == "" {
+        consumer = b.nextName("ctag-")
+    }
+
+    ch.replyTo = b.nextName(DirectReplyTo + ".")
+
+    queue := &fakeQueue{
+        name:       ch.replyTo,
+        autoDelete: true,
+        owner:      ch.conn,
+    }
+
+    c := &fakeConsumer{
+        tag:        consumer,
+        queue:      queue,
+        channel:    ch,
+        autoAck:    true,
+        deliveries: make(chan amqp.Delivery),
+    }
+
+    b.queues[queue.name] = queue
+    ch.consumers[consumer] = c
+    queue.consumers = append(queue.consumers, c)
+
+    return c.deliveries, nil
+}
+
+// Qos sets the channel prefetch count when global, otherwise the one of the
+// consumers started afterwards, like RabbitMQ does. prefetchSize is ignored.
+func (ch *FakeBrokerChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    if global {
+        ch.prefetch = prefetchCount
+        for _, c := range ch.consumers {
+            b.dispatch(c.queue)
+        }
+    } else {
+        ch.consumerPrefetch = prefetchCount
+    }
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) Cancel(consumer string, noWait bool) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    if c, ok := ch.consumers[consumer]; ok {
+        ch.removeConsumer(c)
+        ch.mailbox.post(func() {
+            close(c.deliveries)
+        })
+    }
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) Ack(tag uint64, multiple bool) error {
+    return ch.settle(tag, multiple, func(b *FakeBroker, unacked *fakeUnacked) {})
+}
+
+func (ch *FakeBrokerChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+    return ch.settle(tag, multiple, func(b *FakeBroker, unacked *fakeUnacked) {
+        if requeue {
+            unacked.message.redelivered = true
+            unacked.queue.messages = append([]*fakeMessage{unacked.message}, unacked.queue.messages...)
+            b.dispatch(unacked.queue)
+        } else {
+            b.deadLetter(unacked.queue, unacked.message)
+        }
+    })
+}
+
+func (ch *FakeBrokerChannel) Reject(tag uint64, requeue bool) error {
+    return ch.Nack(tag, false, requeue)
+}
+
+func (ch *FakeBrokerChannel) settle(tag uint64, multiple bool, fn func(*FakeBroker, *fakeUnacked)) error {
+    b, err := ch.lock()
+    if err != nil {
+        return err
+    }
+    defer b.mu.Unlock()
+
+    var settled []*fakeUnacked
+
+    if multiple {
+        settled = ch.unackedUpTo(tag)
+    } else if unacked, ok := ch.unacked[tag]; ok {
+        settled = []*fakeUnacked{unacked}
+    }
+
+    if len(settled) == 0 {
+        return ch.exception(amqp.PreconditionFailed, fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag))
+    }
+
+    for _, unacked := range settled {
+        delete(ch.unacked, unacked.tag)
+        unacked.queue.unacked--
+        unacked.consumer.unacked--
+        fn(b, unacked)
+    }
+
+    for _, unacked := range settled {
+        if _, ok := b.queues[unacked.queue.name]; ok {
+            b.dispatch(unacked.queue)
+        }
+    }
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) unackedUpTo(tag uint64) []*fakeUnacked {
+    var result []*fakeUnacked
+
+    for t, unacked := range ch.unacked {
+        if t <= tag {
+            result = append(result, unacked)
+        }
+    }
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].tag < result[j].tag
+    })
+
+    return result
+}
+
+func (ch *FakeBrokerChannel) Close() error {
+    b := ch.conn.broker
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    ch.shutdown(nil)
+
+    return nil
+}
+
+func (ch *FakeBrokerChannel) removeConsumer(c *fakeConsumer) {
+    b := ch.conn.broker
+    delete(ch.consumers, c.tag)
+
+    consumers := c.queue.consumers[:0]
+    for _, other := range c.queue.consumers {
+        if other != c {
+            consumers = append(consumers, other)
+        }
+    }
+    c.queue.consumers = consumers
+
+    if c.queue.autoDelete && len(consumers) == 0 {
+        b.deleteQueue(c.queue)
+    }
+}
+
+// shutdown requeues the unacked deliveries and notifies the listeners the
+// same way amqp.Channel does. Must be called with b.mu held.
+func (ch *FakeBrokerChannel) shutdown(reason *amqp.Error) {
+    if ch.closed {
+        return
+    }
+
+    b := ch.conn.broker
+
+    ch.closed = true
+    close(ch.done)
+    delete(ch.conn.channels, ch)
+
+    requeued := ch.unackedUpTo(^uint64(0))
+
+    for i := len(requeued) - 1; i >= 0; i-- {
+        unacked := requeued[i]
+        unacked.queue.unacked--
+        unacked.message.redelivered = true
+        unacked.queue.messages = append([]*fakeMessage{unacked.message}, unacked.queue.messages...)
+    }
+
+    ch.unacked = nil
+
+    consumers := make([]*fakeConsumer, 0, len(ch.consumers))
+    for _, c := range ch.consumers {
+        consumers = append(consumers, c)
+        ch.removeConsumer(c)
+    }
+
+    for _, unacked := range requeued {
+        if _, ok := b.queues[unacked.queue.name]; ok {
+            b.dispatch(unacked.queue)
+        }
+    }
+
+    closes := ch.closes
+    confirms := ch.confirms
+    ch.closes = nil
+    ch.confirms = nil
+
+    ch.mailbox.post(func() {
+        if reason != nil {
+            for _, receiver := range closes {
+                receiver <- reason
+            }
+        }
+        for _, c := range consumers {
+            close(c.deliveries)
+        }
+        for _, receiver := range closes {
+            close(receiver)
+        }
+        for _, confirm := range confirms {
+            close(confirm)
+        }
+    })
+
+    ch.mailbox.post(nil)
+}
+
+// deliver sends message to the consumer. Must be called with b.mu held.
+func (c *fakeConsumer) deliver(message *fakeMessage) {
+    ch := c.channel
+
+    ch.deliveryTag++
+
+    if !c.autoAck {
+        ch.unacked[ch.deliveryTag] = &fakeUnacked{ch.deliveryTag, c.queue, c, message}
+        c.queue.unacked++
+        c.unacked++
+    }
+
+    msg := message.msg
+
+    delivery := amqp.Delivery{
+        Acknowledger:       ch,
+        Headers:            msg.Headers,
+        ContentType:        msg.ContentType,
+        ContentEncoding:    msg.ContentEncoding,
+        DeliveryMode:       msg.DeliveryMode,
+        Priority:           msg.Priority,
+        CorrelationId:      msg.CorrelationId,
+        ReplyTo:            msg.ReplyTo,
+        Expiration:         msg.Expiration,
+        MessageId:          msg.MessageId,
+        Timestamp:          msg.Timestamp,
+        Type:               msg.Type,
+        UserId:             msg.UserId,
+        AppId:              msg.AppId,
+        ConsumerTag:        c.tag,
+        DeliveryTag:        ch.deliveryTag,
+        Redelivered:        message.redelivered,
+        Exchange:           message.exchange,
+        RoutingKey:         message.key,
+        Body:               msg.Body,
+    }
+
+    deliveries := c.deliveries
+    done := ch.done
+
+    ch.mailbox.post(func() {
+        select {
+        case deliveries <- delivery:
+        case <- done:
+        }
+    })
+}
+
+
+// fakeMailbox runs posted functions one at a time in its own goroutine so
+// the broker never blocks on a slow listener while holding its lock.
+// Posting nil stops it.
+type fakeMailbox struct {
+    mu      sync.Mutex
+    items   []func()
+    signal  chan struct{}
+}
+
+func newFakeMailbox() *fakeMailbox {
+    mailbox := &fakeMailbox{
+        signal: make(chan struct{}, 1),
+    }
+    go mailbox.loop()
+    return mailbox
+}
+
+func (m *fakeMailbox) post(fn func()) {
+    m.mu.Lock()
+    m.items = append(m.items, fn)
+    m.mu.Unlock()
+
+    select {
+    case m.signal <- struct{}{}:
+    default:
+    }
+}
+
+func (m *fakeMailbox) loop() {
+    for range m.signal {
+        for {
+            m.mu.Lock()
+            if len(m.items) == 0 {
+                m.mu.Unlock()
+                break
+            }
+            fn := m.items[0]
+            m.items = m.items[1:]
+            m.mu.Unlock()
+
+            if fn == nil {
+                return
+            }
+
+            fn()
+        }
+    }
+}
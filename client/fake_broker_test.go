@@ -0,0 +1,378 @@
+package client
+
+import (
+    "time"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+    txWorker "github.com/serenity-77/bagudung/worker"
+)
+
+
+func fakeBrokerChannel(t *testing.T, broker *FakeBroker) (*FakeBrokerConnection, *FakeBrokerChannel) {
+    conn, err := broker.Dial(_DIAL_URL_TEST, nil)
+    assert.Nil(t, err)
+    channel, err := conn.Channel()
+    assert.Nil(t, err)
+    return conn.(*FakeBrokerConnection), channel.(*FakeBrokerChannel)
+}
+
+func TestTopicMatches(t *testing.T) {
+    cases := []struct {
+        pattern string
+        key     string
+        matches bool
+    }{
+        {"order.created", "order.created", true},
+        {"order.created", "order.deleted", false},
+        {"order.*", "order.created", true},
+        {"order.*", "order.created.eu", false},
+        {"order.#", "order", true},
+        {"order.#", "order.created.eu", true},
+        {"#", "anything.at.all", true},
+        {"*.created", "order.created", true},
+        {"#.eu", "order.created.eu", true},
+        {"#.eu", "order.created.us", false},
+        {"order.*.eu", "order.created.eu", true},
+    }
+
+    exchange := &fakeExchange{kind: amqp.ExchangeTopic}
+
+    for _, c := range cases {
+        assert.Equal(t, c.matches, exchange.matches(c.pattern, c.key), "%s %s", c.pattern, c.key)
+    }
+}
+
+func TestFakeBrokerRouting(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    topology := &Topology{
+        Exchanges: []ExchangeSpec{
+            {Name: "direct", Kind: amqp.ExchangeDirect},
+            {Name: "fanout", Kind: amqp.ExchangeFanout},
+            {Name: "topic", Kind: amqp.ExchangeTopic},
+        },
+        Queues: []QueueSpec{{Name: "q1"}, {Name: "q2"}, {Name: "q3"}},
+        Bindings: []BindingSpec{
+            {Queue: "q1", Exchange: "direct", Key: "k1"},
+            {Queue: "q2", Exchange: "direct", Key: "k2"},
+            {Queue: "q1", Exchange: "fanout"},
+            {Queue: "q2", Exchange: "fanout"},
+            {Queue: "q3", Exchange: "fanout"},
+            {Queue: "q3", Exchange: "topic", Key: "order.#"},
+            {Queue: "q3", Exchange: "topic", Key: "order.*"},
+        },
+    }
+
+    assert.Nil(t, topology.Declare(channel))
+
+    publish := func(exchange, key string) {
+        assert.Nil(t, channel.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{}))
+    }
+
+    publish("direct", "k1")
+    publish("direct", "k2")
+    publish("direct", "unknown")
+    publish("fanout", "")
+    publish("topic", "order.created")
+    publish("topic", "invoice.created")
+    publish("", "q2")
+
+    assert.Equal(t, 2, broker.QueueMessages("q1"))
+    assert.Equal(t, 3, broker.QueueMessages("q2"))
+    assert.Equal(t, 2, broker.QueueMessages("q3"))
+}
+
+func TestFakeBrokerConsumeAck(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    channel.QueueDeclare("jobs", true, false, false, false, nil)
+
+    broker.Publish("", "jobs", amqp.Publishing{Body: []byte("1"), MessageId: "m1"})
+    broker.Publish("", "jobs", amqp.Publishing{Body: []byte("2")})
+
+    deliveries, err := channel.Consume("jobs", "", false, false, false, false, nil)
+    assert.Nil(t, err)
+
+    first := <- deliveries
+    second := <- deliveries
+
+    assert.Equal(t, []byte("1"), first.Body)
+    assert.Equal(t, "m1", first.MessageId)
+    assert.Equal(t, "jobs", first.RoutingKey)
+    assert.Equal(t, uint64(1), first.DeliveryTag)
+    assert.Equal(t, uint64(2), second.DeliveryTag)
+    assert.Equal(t, 0, broker.QueueMessages("jobs"))
+    assert.Equal(t, 2, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 1, broker.QueueConsumers("jobs"))
+
+    assert.Nil(t, second.Ack(true))
+    assert.Equal(t, 0, broker.QueueUnacked("jobs"))
+
+    // unknown delivery tag is a channel error
+    assert.NotNil(t, first.Ack(false))
+    assert.True(t, channel.closed)
+}
+
+func TestFakeBrokerNack(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    channel.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil)
+    channel.QueueDeclare("dead", true, false, false, false, nil)
+    channel.QueueBind("dead", "", "dlx", false, nil)
+    channel.QueueDeclare("jobs", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+
+    broker.Publish("", "jobs", amqp.Publishing{Body: []byte("1")})
+
+    deliveries, _ := channel.Consume("jobs", "", false, false, false, false, nil)
+
+    delivery := <- deliveries
+    assert.False(t, delivery.Redelivered)
+    assert.Nil(t, delivery.Nack(false, true))
+
+    delivery = <- deliveries
+    assert.True(t, delivery.Redelivered)
+    assert.Nil(t, delivery.Reject(false))
+
+    assert.Equal(t, 0, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 1, broker.QueueMessages("dead"))
+}
+
+func TestFakeBrokerQos(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    channel.QueueDeclare("jobs", true, false, false, false, nil)
+
+    for i := 0; i < 5; i++ {
+        broker.Publish("", "jobs", amqp.Publishing{})
+    }
+
+    assert.Nil(t, channel.Qos(2, 0, false))
+
+    deliveries, _ := channel.Consume("jobs", "", false, false, false, false, nil)
+
+    first := <- deliveries
+    <- deliveries
+
+    assert.Equal(t, 2, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 3, broker.QueueMessages("jobs"))
+
+    assert.Nil(t, first.Ack(false))
+    <- deliveries
+
+    assert.Equal(t, 2, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 2, broker.QueueMessages("jobs"))
+
+    // the per consumer count sticks to the consumers started before
+    assert.Nil(t, channel.Qos(0, 0, false))
+    assert.Nil(t, channel.Qos(3, 0, true))
+    assert.Equal(t, 2, broker.QueueMessages("jobs"))
+
+    others, _ := channel.Consume("jobs", "", false, false, false, false, nil)
+    <- others
+
+    assert.Equal(t, 3, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 1, broker.QueueMessages("jobs"))
+}
+
+func TestFakeBrokerChannelCloseRequeue(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    conn, channel := fakeBrokerChannel(t, broker)
+
+    channel.QueueDeclare("jobs", true, false, false, false, nil)
+
+    for _, body := range []string{"1", "2", "3"} {
+        broker.Publish("", "jobs", amqp.Publishing{Body: []byte(body)})
+    }
+
+    deliveries, _ := channel.Consume("jobs", "", false, false, false, false, nil)
+
+    <- deliveries
+    <- deliveries
+
+    closes := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+    channel.Close()
+
+    _, ok := <- closes
+    assert.False(t, ok)
+
+    for range deliveries {
+    }
+
+    assert.Equal(t, 3, broker.QueueMessages("jobs"))
+    assert.Equal(t, 0, broker.QueueUnacked("jobs"))
+    assert.Equal(t, 0, broker.QueueConsumers("jobs"))
+
+    newChannel, _ := conn.Channel()
+    deliveries, _ = newChannel.Consume("jobs", "", true, false, false, false, nil)
+
+    for _, body := range []string{"1", "2", "3"} {
+        delivery := <- deliveries
+        assert.Equal(t, []byte(body), delivery.Body)
+        // the third one was sent to the consumer too, it was never read
+        assert.True(t, delivery.Redelivered)
+    }
+}
+
+func TestFakeBrokerChannelExceptions(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    conn, channel := fakeBrokerChannel(t, broker)
+
+    closes := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+    assert.Nil(t, channel.PublishWithContext(context.Background(), "missing", "", false, false, amqp.Publishing{}))
+
+    reason := <- closes
+    assert.Equal(t, amqp.NotFound, reason.Code)
+    assert.True(t, reason.Recover)
+
+    assert.ErrorIs(t, channel.PublishWithContext(context.Background(), "", "", false, false, amqp.Publishing{}), amqp.ErrClosed)
+
+    newChannel, _ := conn.Channel()
+    err := newChannel.QueueBind("missing", "", "amq.direct", false, nil)
+    assert.Equal(t, amqp.NotFound, err.(*amqp.Error).Code)
+
+    newChannel, _ = conn.Channel()
+    _, err = newChannel.Consume("missing", "", false, false, false, false, nil)
+    assert.Equal(t, amqp.NotFound, err.(*amqp.Error).Code)
+
+    newChannel, _ = conn.Channel()
+    err = newChannel.ExchangeDeclare("amq.topic", amqp.ExchangeDirect, true, false, false, false, nil)
+    assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+}
+
+func TestFakeBrokerExclusiveQueue(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    conn, channel := fakeBrokerChannel(t, broker)
+    _, other := fakeBrokerChannel(t, broker)
+
+    queue, err := channel.QueueDeclare("", false, false, true, false, nil)
+    assert.Nil(t, err)
+    assert.Contains(t, queue.Name, "amq.gen-")
+
+    _, err = other.QueueDeclare(queue.Name, false, false, true, false, nil)
+    assert.Equal(t, amqp.ResourceLocked, err.(*amqp.Error).Code)
+
+    assert.Nil(t, conn.Close())
+    assert.ErrorIs(t, conn.Close(), amqp.ErrClosed)
+
+    assert.False(t, broker.HasQueue(queue.Name))
+    assert.Equal(t, 1, broker.Connections())
+}
+
+func TestFakeBrokerAutoDeleteQueue(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    channel.QueueDeclare("temp", false, true, false, false, nil)
+    channel.QueueBind("temp", "temp", "amq.direct", false, nil)
+
+    channel.Consume("temp", "consumer", false, false, false, false, nil)
+    assert.Nil(t, channel.Cancel("consumer", false))
+
+    assert.False(t, broker.HasQueue("temp"))
+    assert.Nil(t, broker.Publish("amq.direct", "temp", amqp.Publishing{}))
+}
+
+func TestFakeBrokerConfirms(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    assert.Nil(t, channel.Confirm(false))
+
+    confirms := channel.NotifyPublish(make(chan amqp.Confirmation))
+
+    for i := 0; i < 3; i++ {
+        channel.PublishWithContext(context.Background(), "", "nowhere", false, false, amqp.Publishing{})
+    }
+
+    for tag := uint64(1); tag <= 3; tag++ {
+        assert.Equal(t, amqp.Confirmation{DeliveryTag: tag, Ack: true}, <- confirms)
+    }
+
+    channel.Close()
+
+    _, ok := <- confirms
+    assert.False(t, ok)
+}
+
+func TestFakeBrokerDown(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    broker.SetDown(true)
+
+    _, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil)
+    assert.ErrorIs(t, err, ErrFakeBrokerDown)
+
+    broker.SetDown(false)
+
+    client, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil)
+    assert.Nil(t, err)
+    assert.Nil(t, client.Disconnect())
+    assert.Equal(t, 0, broker.Connections())
+}
+
+func waitEvent(events chan AmqpEvent, eventType AmqpEventType) AmqpEvent {
+    for event := range events {
+        if event.Type == eventType {
+            return event
+        }
+    }
+    return AmqpEvent{}
+}
+
+func TestFakeBrokerAmqpClientReconnect(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    broker := NewFakeBroker(clock)
+
+    client, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs", Durable: true}},
+    }))
+
+    assert.Nil(t, err)
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 100))
+
+    received := make(chan string, 10)
+
+    worker := txWorker.NewWorker(
+        txWorker.NewProducer(NewAmqpProducerHandler(client, "jobs", nil)),
+        txWorker.NewConsumer(NewAmqpDeliveryHandler(func(delivery amqp.Delivery) error {
+            received <- string(delivery.Body)
+            return nil
+        }, false), 1),
+    )
+
+    assert.Nil(t, client.Publish(context.Background(), "", "jobs", amqp.Publishing{Body: []byte("before")}))
+    assert.Equal(t, "before", <- received)
+
+    broker.SetDown(true)
+    broker.DropConnections(nil)
+
+    assert.Equal(t, amqp.ConnectionForced, waitEvent(events, EventDisconnected).Reason.Code)
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(2 * time.Second)
+
+    waitEvent(events, EventReconnectFailed)
+
+    broker.SetDown(false)
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(4 * time.Second)
+
+    waitEvent(events, EventConnected)
+
+    assert.Nil(t, client.Publish(context.Background(), "", "jobs", amqp.Publishing{Body: []byte("after")}))
+    assert.Equal(t, "after", <- received)
+
+    worker.Stop()
+    client.Disconnect()
+}
@@ -0,0 +1,611 @@
+package client
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strconv"
+    "strings"
+    "hash/crc32"
+    "encoding/gob"
+    "path/filepath"
+    "encoding/binary"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+var _ io.Closer = (*Outbox)(nil)
+
+var (
+    ErrOutboxFull       = errors.New("amqp: outbox is full")
+    ErrOutboxClosed     = errors.New("amqp: outbox closed")
+)
+
+// OutboxCorruptError is returned for a record which does not match its
+// checksum. Only a torn record at the end of the last segment, left by a
+// crash while appending, is dropped silently.
+type OutboxCorruptError struct {
+    Path    string
+    Offset  int64
+}
+
+func (e *OutboxCorruptError) Error() string {
+    return fmt.Sprintf("amqp: outbox %s corrupt at offset %d", e.Path, e.Offset)
+}
+
+// OutboxSync tells when the outbox files are flushed to disk.
+type OutboxSync int
+
+const (
+    // OutboxSyncAlways syncs every record before Publish returns and every
+    // published record before the next one is read.
+    OutboxSyncAlways OutboxSync = iota
+    // OutboxSyncSegment syncs a segment when the next one is started, so
+    // the records of the last segment can be lost with the machine.
+    OutboxSyncSegment
+    // OutboxSyncNever leaves it to the operating system.
+    OutboxSyncNever
+)
+
+const (
+    outboxHeaderSize        = 8
+    outboxCursorSize        = 16
+    outboxSegmentSize       = 16 << 20
+)
+
+func init() {
+    // header values are encoded as interface{}, gob has to know their types
+    gob.Register(amqp.Table{})
+    gob.Register([]interface{}{})
+    gob.Register(amqp.Decimal{})
+    gob.Register(time.Time{})
+}
+
+type OutboxConfig struct {
+    SegmentSize     int64           // a new segment is started beyond, 16MB by default
+    MaxSize         int64           // Publish fails with ErrOutboxFull beyond, 0 is no limit
+    Sync            OutboxSync
+    RetryDelay      time.Duration   // before publishing a record again after an error, 1s by default
+    Perm            os.FileMode
+    Clock           txUtils.IClock
+}
+
+type outboxRecord struct {
+    Exchange    string
+    Key         string
+    Msg         amqp.Publishing
+}
+
+type outboxSegment struct {
+    seq     uint64
+    size    int64
+}
+
+// Outbox writes publishings to segment files in directory first and
+// publishes them from there in the background, so they survive broker
+// outages and restarts. The segments are named after name with an
+// increasing sequence number, name.cursor keeps how far they are published.
+//
+// Records are published one at a time in the order they were written, the
+// next one only after the broker confirmed the previous. A record which
+// fails is published again after RetryDelay, it never is skipped. A record
+// is removed once confirmed, a crash in between publishes it again on the
+// next NewOutbox, so delivery is at least once.
+//
+// MaxSize counts the published records of the segment being read as well,
+// a segment is removed once all its records are published and the next one
+// is started.
+type Outbox struct {
+    client          *AmqpClient
+    name, directory, path string
+    config          OutboxConfig
+    mu              sync.Mutex
+    segments        []*outboxSegment
+    writer          *os.File
+    reader          *os.File
+    readOffset      int64
+    cursor          *os.File
+    size            int64
+    pending         int
+    closed          bool
+    wake            chan struct{}
+    ctx             context.Context
+    cancel          context.CancelFunc
+    stopped         chan struct{}
+}
+
+func NewOutbox(client *AmqpClient, name, directory string, config OutboxConfig) (*Outbox, error) {
+    if config.SegmentSize <= 0 {
+        config.SegmentSize = outboxSegmentSize
+    }
+
+    if config.RetryDelay <= 0 {
+        config.RetryDelay = time.Second
+    }
+
+    if config.Perm == 0 {
+        config.Perm = 0644
+    }
+
+    if config.Clock == nil {
+        config.Clock = txUtils.NewRealClock()
+    }
+
+    if err := os.MkdirAll(directory, 0755); err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    outbox := &Outbox{
+        client:     client,
+        name:       name,
+        directory:  directory,
+        path:       filepath.Join(directory, name),
+        config:     config,
+        wake:       make(chan struct{}, 1),
+        ctx:        ctx,
+        cancel:     cancel,
+        stopped:    make(chan struct{}),
+    }
+
+    if err := outbox.open(); err != nil {
+        cancel()
+        outbox.closeFiles()
+        return nil, err
+    }
+
+    go outbox.drainLoop()
+
+    return outbox, nil
+}
+
+func (o *Outbox) segmentPath(seq uint64) string {
+    return fmt.Sprintf("%s.%010d", o.path, seq)
+}
+
+// open reads the cursor, removes the published segments, checks the others
+// and opens the last one for appending.
+func (o *Outbox) open() error {
+    paths, err := filepath.Glob(o.path + ".*")
+
+    if err != nil {
+        return err
+    }
+
+    for _, path := range paths {
+        if seq, err := strconv.ParseUint(strings.TrimPrefix(path, o.path + "."), 10, 64); err == nil {
+            o.segments = append(o.segments, &outboxSegment{seq: seq})
+        }
+    }
+
+    sort.Slice(o.segments, func(i, j int) bool {
+        return o.segments[i].seq < o.segments[j].seq
+    })
+
+    if o.cursor, err = os.OpenFile(o.path + ".cursor", os.O_RDWR | os.O_CREATE, o.config.Perm); err != nil {
+        return err
+    }
+
+    var cursorSeq uint64
+    var cursorOffset int64
+
+    buf := make([]byte, outboxCursorSize)
+
+    if n, _ := o.cursor.ReadAt(buf, 0); n == outboxCursorSize {
+        cursorSeq = binary.BigEndian.Uint64(buf)
+        cursorOffset = int64(binary.BigEndian.Uint64(buf[8:]))
+    }
+
+    for len(o.segments) > 0 && o.segments[0].seq < cursorSeq {
+        if err := os.Remove(o.segmentPath(o.segments[0].seq)); err != nil {
+            return err
+        }
+        o.segments = o.segments[1:]
+    }
+
+    if len(o.segments) > 0 && o.segments[0].seq == cursorSeq {
+        o.readOffset = cursorOffset
+    }
+
+    for i, segment := range o.segments {
+        from := int64(0)
+        if i == 0 {
+            from = o.readOffset
+        }
+        if err := o.scan(segment, from, i == len(o.segments) - 1); err != nil {
+            return err
+        }
+        o.size += segment.size
+    }
+
+    if len(o.segments) == 0 {
+        seq := cursorSeq
+        if seq == 0 {
+            seq = 1
+        }
+        o.segments = append(o.segments, &outboxSegment{seq: seq})
+        o.readOffset = 0
+    }
+
+    last := o.segments[len(o.segments) - 1]
+
+    o.writer, err = os.OpenFile(o.segmentPath(last.seq), os.O_WRONLY | os.O_CREATE | os.O_APPEND, o.config.Perm)
+
+    return err
+}
+
+// scan sets the size of segment and counts its records from offset from on
+// as pending. A bad record running up to the end of the last segment is the
+// torn one a crash left behind and is truncated, any other is corrupt.
+func (o *Outbox) scan(segment *outboxSegment, from int64, last bool) error {
+    path := o.segmentPath(segment.seq)
+
+    file, err := os.Open(path)
+
+    if err != nil {
+        return err
+    }
+
+    defer file.Close()
+
+    info, err := file.Stat()
+
+    if err != nil {
+        return err
+    }
+
+    offset := int64(0)
+
+    for offset < info.Size() {
+        _, end, err := readOutboxRecord(file, offset, info.Size())
+
+        if err != nil {
+            torn := errors.Is(err, io.ErrUnexpectedEOF) || end == info.Size()
+
+            if !last || !torn {
+                return &OutboxCorruptError{path, offset}
+            }
+
+            if err := os.Truncate(path, offset); err != nil {
+                return err
+            }
+
+            break
+        }
+
+        if offset >= from {
+            o.pending++
+        }
+        offset = end
+    }
+
+    segment.size = offset
+
+    return nil
+}
+
+// readOutboxRecord reads the record at offset of a file of size bytes. A
+// record running past size fails with io.ErrUnexpectedEOF, for any other
+// bad record the offset it ends at is returned with the error.
+func readOutboxRecord(file *os.File, offset int64, size int64) (*outboxRecord, int64, error) {
+    if size - offset < outboxHeaderSize {
+        return nil, 0, io.ErrUnexpectedEOF
+    }
+
+    header := make([]byte, outboxHeaderSize)
+
+    if _, err := file.ReadAt(header, offset); err != nil {
+        return nil, 0, err
+    }
+
+    length := int64(binary.BigEndian.Uint32(header))
+    end := offset + outboxHeaderSize + length
+
+    if end > size {
+        return nil, 0, io.ErrUnexpectedEOF
+    }
+
+    payload := make([]byte, length)
+
+    if _, err := file.ReadAt(payload, offset + outboxHeaderSize); err != nil {
+        return nil, 0, err
+    }
+
+    if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+        return nil, end, &OutboxCorruptError{file.Name(), offset}
+    }
+
+    record := &outboxRecord{}
+
+    if err := GobCodec.Unmarshal(payload, record); err != nil {
+        return nil, end, err
+    }
+
+    return record, end, nil
+}
+
+// Publish writes msg to the outbox, it is published to the broker later.
+func (o *Outbox) Publish(exchange, key string, msg amqp.Publishing) error {
+    payload, err := GobCodec.Marshal(&outboxRecord{exchange, key, msg})
+
+    if err != nil {
+        return err
+    }
+
+    record := make([]byte, outboxHeaderSize + len(payload))
+    binary.BigEndian.PutUint32(record, uint32(len(payload)))
+    binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+    copy(record[outboxHeaderSize:], payload)
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if o.closed {
+        return ErrOutboxClosed
+    }
+
+    if o.config.MaxSize > 0 && o.size + int64(len(record)) > o.config.MaxSize {
+        return ErrOutboxFull
+    }
+
+    last := o.segments[len(o.segments) - 1]
+
+    if last.size > 0 && last.size + int64(len(record)) > o.config.SegmentSize {
+        if err := o.rotate(); err != nil {
+            return err
+        }
+        last = o.segments[len(o.segments) - 1]
+    }
+
+    if _, err := o.writer.Write(record); err != nil {
+        // do not leave a torn record in front of the next one
+        o.writer.Truncate(last.size)
+        return err
+    }
+
+    if o.config.Sync == OutboxSyncAlways {
+        if err := o.writer.Sync(); err != nil {
+            // the caller is told it failed, so it must not be published
+            o.writer.Truncate(last.size)
+            return err
+        }
+    }
+
+    last.size += int64(len(record))
+    o.size += int64(len(record))
+    o.pending++
+
+    select {
+    case o.wake <- struct{}{}:
+    default:
+    }
+
+    return nil
+}
+
+// rotate must be called with o.mu held.
+func (o *Outbox) rotate() error {
+    if o.config.Sync != OutboxSyncNever {
+        if err := o.writer.Sync(); err != nil {
+            return err
+        }
+    }
+
+    seq := o.segments[len(o.segments) - 1].seq + 1
+
+    writer, err := os.OpenFile(o.segmentPath(seq), os.O_WRONLY | os.O_CREATE | os.O_APPEND, o.config.Perm)
+
+    if err != nil {
+        return err
+    }
+
+    o.writer.Close()
+    o.writer = writer
+    o.segments = append(o.segments, &outboxSegment{seq: seq})
+
+    return nil
+}
+
+// Pending returns the number of records not published yet.
+func (o *Outbox) Pending() int {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    return o.pending
+}
+
+// Size returns the bytes used by the segments.
+func (o *Outbox) Size() int64 {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    return o.size
+}
+
+// Close stops publishing, the records left are published by the next
+// NewOutbox on the same directory and name.
+func (o *Outbox) Close() error {
+    o.mu.Lock()
+    if o.closed {
+        o.mu.Unlock()
+        return ErrOutboxClosed
+    }
+    o.closed = true
+    o.mu.Unlock()
+
+    o.cancel()
+    <- o.stopped
+
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    if o.config.Sync != OutboxSyncNever {
+        o.writer.Sync()
+    }
+
+    return o.closeFiles()
+}
+
+func (o *Outbox) closeFiles() error {
+    var err error
+
+    for _, file := range []*os.File{o.writer, o.reader, o.cursor} {
+        if file != nil {
+            if closeErr := file.Close(); err == nil {
+                err = closeErr
+            }
+        }
+    }
+
+    o.writer, o.reader, o.cursor = nil, nil, nil
+
+    return err
+}
+
+func (o *Outbox) drainLoop() {
+    defer close(o.stopped)
+
+    for {
+        record, end, ok := o.next()
+
+        if !ok || !o.publish(record) {
+            return
+        }
+
+        if err := o.commit(end); err != nil {
+            o.client.log().Errorf("Outbox %s cursor error: %#v", o.name, err)
+        }
+    }
+}
+
+// next waits for the next record, it returns false when the outbox is
+// closed.
+func (o *Outbox) next() (*outboxRecord, int64, bool) {
+    for {
+        o.mu.Lock()
+        record, end, err := o.read()
+        o.mu.Unlock()
+
+        if err != nil {
+            // the record can not be skipped without breaking the order
+            o.client.log().Errorf("Outbox %s read error: %#v", o.name, err)
+            <- o.ctx.Done()
+            return nil, 0, false
+        }
+
+        if record != nil {
+            return record, end, true
+        }
+
+        select {
+        case <- o.wake:
+        case <- o.ctx.Done():
+            return nil, 0, false
+        }
+    }
+}
+
+// read returns the record at the read offset or nil when there is none, it
+// removes the segments which are read up. Must be called with o.mu held.
+func (o *Outbox) read() (*outboxRecord, int64, error) {
+    for {
+        head := o.segments[0]
+
+        if o.readOffset < head.size {
+            if o.reader == nil {
+                reader, err := os.Open(o.segmentPath(head.seq))
+                if err != nil {
+                    return nil, 0, err
+                }
+                o.reader = reader
+            }
+            return readOutboxRecord(o.reader, o.readOffset, head.size)
+        }
+
+        if len(o.segments) == 1 {
+            return nil, 0, nil
+        }
+
+        if o.reader != nil {
+            o.reader.Close()
+            o.reader = nil
+        }
+
+        if err := os.Remove(o.segmentPath(head.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+            return nil, 0, err
+        }
+
+        o.size -= head.size
+        o.segments = o.segments[1:]
+        o.readOffset = 0
+
+        if err := o.writeCursor(); err != nil {
+            return nil, 0, err
+        }
+    }
+}
+
+// publish returns false when the outbox is closed before record is
+// confirmed.
+func (o *Outbox) publish(record *outboxRecord) bool {
+    for {
+        err := o.client.Publish(o.ctx, record.Exchange, record.Key, record.Msg)
+
+        if err == nil {
+            return true
+        }
+
+        if o.ctx.Err() != nil {
+            return false
+        }
+
+        if errors.Is(err, ErrClientClosed) || errors.Is(err, ErrClientFailed) {
+            // the records are left for the next outbox
+            <- o.ctx.Done()
+            return false
+        }
+
+        o.client.log().Errorf("Outbox %s publish error: %#v", o.name, err)
+
+        timer := o.config.Clock.Timer(o.config.RetryDelay)
+
+        select {
+        case <- timer.C:
+        case <- o.ctx.Done():
+            timer.Stop()
+            return false
+        }
+    }
+}
+
+func (o *Outbox) commit(end int64) error {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+
+    o.readOffset = end
+    o.pending--
+
+    return o.writeCursor()
+}
+
+// writeCursor must be called with o.mu held.
+func (o *Outbox) writeCursor() error {
+    buf := make([]byte, outboxCursorSize)
+    binary.BigEndian.PutUint64(buf, o.segments[0].seq)
+    binary.BigEndian.PutUint64(buf[8:], uint64(o.readOffset))
+
+    if _, err := o.cursor.WriteAt(buf, 0); err != nil {
+        return err
+    }
+
+    if o.config.Sync == OutboxSyncAlways {
+        return o.cursor.Sync()
+    }
+
+    return nil
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+    "os"
+    "time"
+    "testing"
+    "path/filepath"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+func outboxBodies(t *testing.T, broker *FakeBroker, queue string, n int) []string {
+    _, channel := fakeBrokerChannel(t, broker)
+
+    deliveries, err := channel.Consume(queue, "", true, false, false, false, nil)
+    assert.Nil(t, err)
+
+    bodies := []string{}
+    for i := 0; i < n; i++ {
+        bodies = append(bodies, string((<- deliveries).Body))
+    }
+
+    return bodies
+}
+
+func outboxClient(broker *FakeBroker) *AmqpClient {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs", Durable: true}},
+    }))
+    return client
+}
+
+func TestOutboxPublish(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    client := outboxClient(broker)
+
+    outbox, err := NewOutbox(client, "jobs", t.TempDir(), OutboxConfig{})
+    assert.Nil(t, err)
+
+    for _, body := range []string{"1", "2", "3"} {
+        assert.Nil(t, outbox.Publish("", "jobs", amqp.Publishing{
+            Headers:    amqp.Table{"attempt": int64(1), "nested": amqp.Table{"at": time.Unix(10, 0)}},
+            Body:       []byte(body),
+        }))
+    }
+
+    assert.Eventually(t, func() bool {
+        return broker.QueueMessages("jobs") == 3
+    }, time.Second, time.Millisecond)
+    assert.Eventually(t, func() bool {
+        return outbox.Pending() == 0
+    }, time.Second, time.Millisecond)
+
+    _, channel := fakeBrokerChannel(t, broker)
+    deliveries, _ := channel.Consume("jobs", "", true, false, false, false, nil)
+
+    for _, body := range []string{"1", "2", "3"} {
+        delivery := <- deliveries
+        assert.Equal(t, body, string(delivery.Body))
+        assert.Equal(t, int64(1), delivery.Headers["attempt"])
+        assert.Equal(t, amqp.Table{"at": time.Unix(10, 0)}, delivery.Headers["nested"])
+    }
+
+    assert.Nil(t, outbox.Close())
+    assert.Equal(t, ErrOutboxClosed, outbox.Close())
+    assert.Equal(t, ErrOutboxClosed, outbox.Publish("", "jobs", amqp.Publishing{}))
+
+    client.Disconnect()
+}
+
+func TestOutboxReplay(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    dir := t.TempDir()
+
+    // records written while the client is gone stay on disk
+    closedClient := outboxClient(broker)
+    closedClient.Disconnect()
+
+    outbox, err := NewOutbox(closedClient, "jobs", dir, OutboxConfig{SegmentSize: 100})
+    assert.Nil(t, err)
+
+    for _, body := range []string{"1", "2", "3", "4"} {
+        assert.Nil(t, outbox.Publish("", "jobs", amqp.Publishing{Body: []byte(body)}))
+    }
+
+    assert.Equal(t, 4, outbox.Pending())
+    assert.Nil(t, outbox.Close())
+
+    segments, _ := filepath.Glob(filepath.Join(dir, "jobs.00*"))
+    assert.Greater(t, len(segments), 1)
+
+    client := outboxClient(broker)
+
+    outbox, err = NewOutbox(client, "jobs", dir, OutboxConfig{SegmentSize: 100})
+    assert.Nil(t, err)
+
+    assert.Equal(t, []string{"1", "2", "3", "4"}, outboxBodies(t, broker, "jobs", 4))
+    assert.Eventually(t, func() bool {
+        return outbox.Pending() == 0
+    }, time.Second, time.Millisecond)
+
+    assert.Nil(t, outbox.Close())
+
+    // the published segments are removed and nothing is published again
+    segments, _ = filepath.Glob(filepath.Join(dir, "jobs.00*"))
+    assert.Equal(t, 1, len(segments))
+
+    outbox, err = NewOutbox(client, "jobs", dir, OutboxConfig{SegmentSize: 100})
+    assert.Nil(t, err)
+    assert.Equal(t, 0, outbox.Pending())
+    assert.Nil(t, outbox.Close())
+
+    client.Disconnect()
+}
+
+func TestOutboxTornRecord(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    dir := t.TempDir()
+
+    client := outboxClient(broker)
+    client.Disconnect()
+
+    outbox, _ := NewOutbox(client, "jobs", dir, OutboxConfig{})
+    outbox.Publish("", "jobs", amqp.Publishing{Body: []byte("1")})
+    size := outbox.Size()
+    outbox.Close()
+
+    path := filepath.Join(dir, "jobs.0000000001")
+
+    file, _ := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0644)
+    file.Write([]byte{0, 0, 1, 0, 1, 2})
+    file.Close()
+
+    outbox, err := NewOutbox(client, "jobs", dir, OutboxConfig{})
+    assert.Nil(t, err)
+    assert.Equal(t, 1, outbox.Pending())
+    assert.Equal(t, size, outbox.Size())
+
+    info, _ := os.Stat(path)
+    assert.Equal(t, size, info.Size())
+
+    outbox.Close()
+}
+
+func TestOutboxCorruptRecord(t *testing.T) {
+    dir := t.TempDir()
+
+    client := outboxClient(NewFakeBroker(nil))
+    client.Disconnect()
+
+    outbox, _ := NewOutbox(client, "jobs", dir, OutboxConfig{})
+    outbox.Publish("", "jobs", amqp.Publishing{Body: []byte("1")})
+    first := outbox.Size()
+    outbox.Publish("", "jobs", amqp.Publishing{Body: []byte("2")})
+    outbox.Publish("", "jobs", amqp.Publishing{Body: []byte("3")})
+    size := outbox.Size()
+    outbox.Close()
+
+    path := filepath.Join(dir, "jobs.0000000001")
+
+    // a flipped byte in the payload of the second record
+    file, _ := os.OpenFile(path, os.O_RDWR, 0644)
+    b := make([]byte, 1)
+    file.ReadAt(b, first + 20)
+    b[0] ^= 0xff
+    file.WriteAt(b, first + 20)
+    file.Close()
+
+    _, err := NewOutbox(client, "jobs", dir, OutboxConfig{})
+
+    var corrupt *OutboxCorruptError
+    assert.ErrorAs(t, err, &corrupt)
+    assert.Equal(t, first, corrupt.Offset)
+
+    // the records after it are kept
+    info, _ := os.Stat(path)
+    assert.Equal(t, size, info.Size())
+}
+
+func TestOutboxMaxSize(t *testing.T) {
+    client := outboxClient(NewFakeBroker(nil))
+    client.Disconnect()
+
+    outbox, _ := NewOutbox(client, "jobs", t.TempDir(), OutboxConfig{MaxSize: 1000})
+
+    var err error
+    for err == nil {
+        err = outbox.Publish("", "jobs", amqp.Publishing{Body: make([]byte, 100)})
+    }
+
+    assert.Equal(t, ErrOutboxFull, err)
+    assert.LessOrEqual(t, outbox.Size(), int64(1000))
+
+    outbox.Close()
+}
+
+func TestOutboxRetry(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    broker := NewFakeBroker(clock)
+    client := outboxClient(broker)
+
+    outbox, _ := NewOutbox(client, "events", t.TempDir(), OutboxConfig{Clock: clock, RetryDelay: time.Second})
+
+    // the exchange is missing, the first record is retried and keeps its
+    // place in front of the second
+    outbox.Publish("events", "jobs", amqp.Publishing{Body: []byte("1")})
+    outbox.Publish("", "jobs", amqp.Publishing{Body: []byte("2")})
+
+    clock.WaitUntilBlock(1)
+    assert.Equal(t, 2, outbox.Pending())
+
+    channel, _ := client.Channel()
+    assert.Nil(t, channel.ExchangeDeclare("events", amqp.ExchangeDirect, true, false, false, false, nil))
+    assert.Nil(t, channel.QueueBind("jobs", "jobs", "events", false, nil))
+
+    clock.Advance(time.Second)
+
+    assert.Equal(t, []string{"1", "2"}, outboxBodies(t, broker, "jobs", 2))
+
+    outbox.Close()
+    client.Disconnect()
+}
@@ -0,0 +1,327 @@
+package client
+
+import (
+    "sort"
+    "errors"
+    "context"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+var (
+    ErrPublishNacked    = errors.New("amqp: publishing nacked by broker")
+)
+
+type publishing struct {
+    ctx         context.Context
+    exchange    string
+    key         string
+    msg         amqp.Publishing
+    result      chan error
+}
+
+func (p *publishing) done(err error) {
+    p.result <- err
+}
+
+// amqpPublisher owns a single confirm mode channel. Publishings which are not
+// confirmed when the channel goes away are published again, in order,
+// once the client is reconnected.
+type amqpPublisher struct {
+    client          *AmqpClient
+    publishings     chan *publishing
+    pending         []*publishing
+    unconfirmed     map[uint64]*publishing
+    stop            chan struct{}
+    stopped         chan struct{}
+}
+
+func newAmqpPublisher(client *AmqpClient) *amqpPublisher {
+    publisher := &amqpPublisher{
+        client:         client,
+        publishings:    make(chan *publishing),
+        unconfirmed:    make(map[uint64]*publishing),
+        stop:           make(chan struct{}),
+        stopped:        make(chan struct{}),
+    }
+    go publisher.publishLoop()
+    return publisher
+}
+
+// Publish sends msg and waits until the broker acks or nacks it.
+// When the connection is lost before the confirmation arrives, msg is
+// published again after reconnecting, so it may be delivered more than once.
+func (c *AmqpClient) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return ErrClientClosed
+    }
+    if c.failed {
+        c.mu.Unlock()
+        return ErrClientFailed
+    }
+    if c.blocked != nil && c.failFastBlocked {
+        err := c.blocked
+        c.mu.Unlock()
+        return err
+    }
+    if c.publisher == nil {
+        c.publisher = newAmqpPublisher(c)
+    }
+    publisher := c.publisher
+    c.mu.Unlock()
+
+    return publisher.Publish(ctx, exchange, key, msg)
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+    pub := &publishing{
+        ctx:        ctx,
+        exchange:   exchange,
+        key:        key,
+        msg:        msg,
+        result:     make(chan error, 1),
+    }
+
+    select {
+    case p.publishings <- pub:
+    case <- p.stopped:
+        return ErrClientClosed
+    case <- ctx.Done():
+        return ctx.Err()
+    }
+
+    select {
+    case err := <- pub.result:
+        return err
+    case <- ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (p *amqpPublisher) Stop() {
+    close(p.stop)
+    <- p.stopped
+}
+
+func (p *amqpPublisher) publishLoop() {
+    defer close(p.stopped)
+
+    for {
+        channel, gen, err := p.client.channelGen()
+
+        if errors.Is(err, ErrClientFailed) || errors.Is(err, ErrClientClosed) {
+            p.failAll(err)
+            p.waitStop(err)
+            return
+        }
+
+        if err == nil {
+            if err = channel.Confirm(false); err != nil {
+                channel.Close()
+            }
+        }
+
+        if err != nil {
+            p.client.log().Errorf("AmqpClient publisher channel error: %#v", err)
+            if !p.waitReconnect(gen) {
+                break
+            }
+            continue
+        }
+
+        if !p.publishOn(channel) {
+            break
+        }
+    }
+
+    p.failAll(ErrClientClosed)
+}
+
+// waitStop fails every incoming publishing with err until stopped.
+func (p *amqpPublisher) waitStop(err error) {
+    for {
+        select {
+        case pub := <- p.publishings:
+            pub.done(err)
+        case <- p.stop:
+            return
+        }
+    }
+}
+
+func (p *amqpPublisher) waitReconnect(gen uint64) bool {
+    reconnected := p.client.waitReconnect(gen)
+
+    for {
+        select {
+        case <- reconnected:
+            return true
+        case pub := <- p.publishings:
+            p.pending = append(p.pending, pub)
+        case <- p.stop:
+            return false
+        }
+    }
+}
+
+// publishOn publishes pending and incoming publishings on channel until it
+// is closed. It returns false when the publisher is stopped.
+func (p *amqpPublisher) publishOn(channel IAmqpChannel) bool {
+    confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+    closes := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+    var tag uint64
+    closed := false
+
+    publish := func(pub *publishing) {
+        if closed {
+            p.pending = append(p.pending, pub)
+            return
+        }
+
+        if err := pub.ctx.Err(); err != nil {
+            pub.done(err)
+            return
+        }
+
+        if err := channel.PublishWithContext(pub.ctx, pub.exchange, pub.key, false, false, pub.msg); err != nil {
+            if errors.Is(err, amqp.ErrClosed) {
+                closed = true
+                p.pending = append(p.pending, pub)
+            } else {
+                pub.done(err)
+            }
+            return
+        }
+
+        tag++
+        p.unconfirmed[tag] = pub
+    }
+
+    pending := p.pending
+    p.pending = nil
+
+    for _, pub := range pending {
+        publish(pub)
+    }
+
+    for {
+        select {
+        case pub := <- p.publishings:
+            publish(pub)
+        case confirmation, ok := <- confirms:
+            if !ok {
+                confirms = nil
+                continue
+            }
+            p.confirm(confirmation)
+        case reason := <- closes:
+            if confirms != nil {
+                for confirmation := range confirms {
+                    p.confirm(confirmation)
+                }
+            }
+            p.requeueUnconfirmed(reason)
+            return true
+        case <- p.stop:
+            p.closeConfirming(channel, confirms)
+            return false
+        }
+    }
+}
+
+// closeConfirming closes channel while reading confirms, the connection
+// delivers the confirms in flight before the close completes and deadlocks
+// when they are not read.
+func (p *amqpPublisher) closeConfirming(channel IAmqpChannel, confirms chan amqp.Confirmation) {
+    closed := make(chan struct{})
+
+    go func() {
+        channel.Close()
+        close(closed)
+    }()
+
+    for {
+        select {
+        case confirmation, ok := <- confirms:
+            if !ok {
+                confirms = nil
+                continue
+            }
+            p.confirm(confirmation)
+        case <- closed:
+            // a confirm may still be buffered
+            for {
+                select {
+                case confirmation, ok := <- confirms:
+                    if !ok {
+                        return
+                    }
+                    p.confirm(confirmation)
+                default:
+                    return
+                }
+            }
+        }
+    }
+}
+
+func (p *amqpPublisher) confirm(confirmation amqp.Confirmation) {
+    pub, ok := p.unconfirmed[confirmation.DeliveryTag]
+
+    if !ok {
+        return
+    }
+
+    delete(p.unconfirmed, confirmation.DeliveryTag)
+
+    if confirmation.Ack {
+        pub.done(nil)
+    } else {
+        pub.done(ErrPublishNacked)
+    }
+}
+
+// requeueUnconfirmed moves unconfirmed publishings in front of the pending
+// ones. A channel level exception means the connection is still alive and the
+// publishing itself was rejected, so those are failed instead.
+func (p *amqpPublisher) requeueUnconfirmed(reason *amqp.Error) {
+    tags := make([]uint64, 0, len(p.unconfirmed))
+    for tag := range p.unconfirmed {
+        tags = append(tags, tag)
+    }
+
+    sort.Slice(tags, func(i, j int) bool {
+        return tags[i] < tags[j]
+    })
+
+    requeued := make([]*publishing, 0, len(tags) + len(p.pending))
+
+    for _, tag := range tags {
+        pub := p.unconfirmed[tag]
+        delete(p.unconfirmed, tag)
+
+        if reason != nil && reason.Recover {
+            pub.done(reason)
+        } else {
+            requeued = append(requeued, pub)
+        }
+    }
+
+    p.pending = append(requeued, p.pending...)
+}
+
+func (p *amqpPublisher) failAll(err error) {
+    for tag, pub := range p.unconfirmed {
+        delete(p.unconfirmed, tag)
+        pub.done(err)
+    }
+
+    for _, pub := range p.pending {
+        pub.done(err)
+    }
+
+    p.pending = nil
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+    "time"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+func publishAsync(client *AmqpClient, ctx context.Context, body string) chan error {
+    result := make(chan error, 1)
+    go func() {
+        result <- client.Publish(ctx, "exchange_test", "key_test", amqp.Publishing{Body: []byte(body)})
+    }()
+    return result
+}
+
+func TestAmqpClientPublishAck(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    result := publishAsync(client, context.Background(), "hello")
+
+    channel := conn.WaitChannel()
+    published := channel.WaitPublished()
+
+    assert.True(t, channel.confirming)
+    assert.Equal(t, "exchange_test", published.exchange)
+    assert.Equal(t, "key_test", published.key)
+    assert.Equal(t, []byte("hello"), published.msg.Body)
+    assert.Equal(t, uint64(1), published.tag)
+
+    channel.Confirmation(published.tag, true)
+
+    assert.Nil(t, <- result)
+}
+
+func TestAmqpClientPublishNack(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    result := publishAsync(client, context.Background(), "hello")
+
+    channel := conn.WaitChannel()
+    published := channel.WaitPublished()
+
+    channel.Confirmation(published.tag, false)
+
+    assert.ErrorIs(t, <- result, ErrPublishNacked)
+}
+
+func TestAmqpClientPublishContextCancel(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    result := publishAsync(client, ctx, "hello")
+
+    channel := conn.WaitChannel()
+    channel.WaitPublished()
+
+    cancel()
+
+    assert.ErrorIs(t, <- result, context.Canceled)
+
+    // late confirmation must not block the publisher
+    channel.Confirmation(1, true)
+
+    result = publishAsync(client, context.Background(), "world")
+    published := channel.WaitPublished()
+    channel.Confirmation(published.tag, true)
+    assert.Nil(t, <- result)
+}
+
+func TestAmqpClientPublishRepublishOnReconnect(t *testing.T) {
+    conns := make(chan *FakeAmqpConnection, 10)
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        conn := NewFakeAmqpConnection()
+        conns <- conn
+        return conn, nil
+    }
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil)
+
+    conn := <- conns
+    conn.WaitNotifyClose()
+
+    result1 := publishAsync(client, context.Background(), "first")
+    channel := conn.WaitChannel()
+    assert.Equal(t, []byte("first"), channel.WaitPublished().msg.Body)
+
+    result2 := publishAsync(client, context.Background(), "second")
+    assert.Equal(t, []byte("second"), channel.WaitPublished().msg.Body)
+
+    result3 := publishAsync(client, context.Background(), "third")
+    assert.Equal(t, []byte("third"), channel.WaitPublished().msg.Body)
+
+    channel.Confirmation(1, true)
+    assert.Nil(t, <- result1)
+
+    conn.TriggerClose(&amqp.Error{
+        Code:       302,
+        Reason:     "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+        Server:     true,
+        Recover:    false,
+    })
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(2 * time.Second)
+
+    newConn := <- conns
+    newConn.WaitNotifyClose()
+
+    newChannel := newConn.WaitChannel()
+
+    published := newChannel.WaitPublished()
+    assert.Equal(t, []byte("second"), published.msg.Body)
+    assert.Equal(t, uint64(1), published.tag)
+
+    published = newChannel.WaitPublished()
+    assert.Equal(t, []byte("third"), published.msg.Body)
+    assert.Equal(t, uint64(2), published.tag)
+
+    newChannel.Confirmation(1, true)
+    newChannel.Confirmation(2, false)
+
+    assert.Nil(t, <- result2)
+    assert.ErrorIs(t, <- result3, ErrPublishNacked)
+}
+
+func TestAmqpClientPublishChannelException(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    result := publishAsync(client, context.Background(), "hello")
+
+    channel := conn.WaitChannel()
+    channel.WaitPublished()
+
+    reason := &amqp.Error{
+        Code:       404,
+        Reason:     "NOT_FOUND - no exchange 'exchange_test' in vhost '/'",
+        Server:     true,
+        Recover:    true,
+    }
+
+    channel.TriggerClose(reason)
+
+    assert.Equal(t, reason, <- result)
+
+    // the publisher opens a new channel on the same connection
+    result = publishAsync(client, context.Background(), "world")
+    newChannel := conn.WaitChannel()
+    published := newChannel.WaitPublished()
+    assert.Equal(t, uint64(1), published.tag)
+    newChannel.Confirmation(published.tag, true)
+    assert.Nil(t, <- result)
+}
+
+func TestAmqpClientPublishDisconnect(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    result := publishAsync(client, context.Background(), "hello")
+
+    channel := conn.WaitChannel()
+    channel.WaitPublished()
+
+    client.Disconnect()
+
+    assert.ErrorIs(t, <- result, ErrClientClosed)
+    assert.Nil(t, client.publisher)
+
+    err := client.Publish(context.Background(), "exchange_test", "key_test", amqp.Publishing{})
+    assert.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestAmqpClientPublishDisconnectConfirming(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    results := []chan error{}
+
+    for i := 0; i < 3; i++ {
+        results = append(results, publishAsync(client, context.Background(), "hello"))
+    }
+
+    channel := conn.WaitChannel()
+
+    for i := 0; i < 3; i++ {
+        channel.WaitPublished()
+    }
+
+    channel.mu.Lock()
+    channel.confirmOnClose = true
+    channel.mu.Unlock()
+
+    // the confirms in flight are read while closing
+    disconnected := make(chan struct{})
+
+    go func() {
+        client.Disconnect()
+        close(disconnected)
+    }()
+
+    if !assert.Eventually(t, func() bool {
+        select {
+        case <- disconnected:
+            return true
+        default:
+            return false
+        }
+    }, time.Second, time.Millisecond) {
+        return
+    }
+
+    for _, result := range results {
+        assert.Nil(t, <- result)
+    }
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+    "math"
+    "time"
+    _mathRand "math/rand"
+)
+
+
+var (
+    _reconnectRandFunc = _mathRand.Float64
+)
+
+var _ ReconnectPolicy = (*linearReconnectPolicy)(nil)
+var _ ReconnectPolicy = (*ConstantReconnectPolicy)(nil)
+var _ ReconnectPolicy = (*ExponentialReconnectPolicy)(nil)
+var _ ReconnectPolicy = (*LimitedReconnectPolicy)(nil)
+
+// ReconnectPolicy decides how long AmqpClient waits before the given
+// reconnect attempt, attempts start at 1. elapsed is the time since the
+// connection was lost. Returning false makes the client give up.
+type ReconnectPolicy interface {
+    NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// linearReconnectPolicy is the default schedule, 2s, 4s, ... 10s and then
+// starting over from 2s, retrying forever.
+type linearReconnectPolicy struct {
+    step    time.Duration
+    steps   int
+}
+
+func (p *linearReconnectPolicy) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+    return time.Duration((attempt - 1) % p.steps + 1) * p.step, true
+}
+
+func defaultReconnectPolicy() ReconnectPolicy {
+    return &linearReconnectPolicy{2 * time.Second, 5}
+}
+
+
+type ConstantReconnectPolicy struct {
+    delay   time.Duration
+}
+
+func NewConstantReconnectPolicy(delay time.Duration) *ConstantReconnectPolicy {
+    return &ConstantReconnectPolicy{delay}
+}
+
+func (p *ConstantReconnectPolicy) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+    return p.delay, true
+}
+
+
+// ExponentialReconnectPolicy multiplies the delay by multiplier on every
+// attempt up to max. With jitter j in [0, 1] the delay is randomized
+// within [delay * (1 - j), delay * (1 + j)].
+type ExponentialReconnectPolicy struct {
+    initial     time.Duration
+    max         time.Duration
+    multiplier  float64
+    jitter      float64
+}
+
+// NewExponentialReconnectPolicy starts at a second when initial is not
+// positive, a max of zero does not cap the delay.
+func NewExponentialReconnectPolicy(initial, max time.Duration, multiplier, jitter float64) *ExponentialReconnectPolicy {
+    if initial <= 0 {
+        initial = time.Second
+    }
+
+    if multiplier < 1 {
+        multiplier = 1
+    }
+
+    if jitter < 0 {
+        jitter = 0
+    } else if jitter > 1 {
+        jitter = 1
+    }
+
+    return &ExponentialReconnectPolicy{
+        initial:    initial,
+        max:        max,
+        multiplier: multiplier,
+        jitter:     jitter,
+    }
+}
+
+func (p *ExponentialReconnectPolicy) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+    delay := exponentialDelay(p.initial, p.max, p.multiplier, attempt)
+
+    if p.jitter > 0 {
+        delay = delay * (1 - p.jitter + 2 * p.jitter * _reconnectRandFunc())
+    }
+
+    return time.Duration(delay), true
+}
+
+// exponentialDelay is initial multiplied attempt - 1 times, up to max. A max
+// of zero is no cap, the delay then stops growing at a quarter of the
+// largest duration, so jitter can not overflow it.
+func exponentialDelay(initial, max time.Duration, multiplier float64, attempt int) float64 {
+    limit := float64(max)
+
+    if max <= 0 {
+        limit = float64(math.MaxInt64 / 4)
+    }
+
+    delay := float64(initial)
+
+    for i := 1; i < attempt && delay < limit; i++ {
+        delay *= multiplier
+    }
+
+    if delay > limit {
+        delay = limit
+    }
+
+    return delay
+}
+
+
+// LimitedReconnectPolicy gives up after maxAttempts attempts or once
+// maxElapsed has passed since the connection was lost. Zero disables the
+// respective limit.
+type LimitedReconnectPolicy struct {
+    policy      ReconnectPolicy
+    maxAttempts int
+    maxElapsed  time.Duration
+}
+
+func NewLimitedReconnectPolicy(policy ReconnectPolicy, maxAttempts int, maxElapsed time.Duration) *LimitedReconnectPolicy {
+    return &LimitedReconnectPolicy{
+        policy:         policy,
+        maxAttempts:    maxAttempts,
+        maxElapsed:     maxElapsed,
+    }
+}
+
+func (p *LimitedReconnectPolicy) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+    if p.maxAttempts > 0 && attempt > p.maxAttempts {
+        return 0, false
+    }
+
+    delay, ok := p.policy.NextDelay(attempt, elapsed)
+
+    if !ok {
+        return 0, false
+    }
+
+    if p.maxElapsed > 0 && elapsed + delay > p.maxElapsed {
+        return 0, false
+    }
+
+    return delay, true
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+    "time"
+    "context"
+    "testing"
+    "sync/atomic"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+func TestLinearReconnectPolicy(t *testing.T) {
+    policy := defaultReconnectPolicy()
+
+    expected := []time.Duration{2, 4, 6, 8, 10, 2, 4, 6, 8, 10, 2}
+
+    for i, seconds := range expected {
+        delay, ok := policy.NextDelay(i + 1, 0)
+        assert.True(t, ok)
+        assert.Equal(t, seconds * time.Second, delay)
+    }
+}
+
+func TestConstantReconnectPolicy(t *testing.T) {
+    policy := NewConstantReconnectPolicy(3 * time.Second)
+
+    for attempt := 1; attempt < 10; attempt++ {
+        delay, ok := policy.NextDelay(attempt, time.Duration(attempt) * time.Hour)
+        assert.True(t, ok)
+        assert.Equal(t, 3 * time.Second, delay)
+    }
+}
+
+func TestExponentialReconnectPolicy(t *testing.T) {
+    policy := NewExponentialReconnectPolicy(time.Second, 30 * time.Second, 2, 0)
+
+    expected := []time.Duration{1, 2, 4, 8, 16, 30, 30, 30}
+
+    for i, seconds := range expected {
+        delay, ok := policy.NextDelay(i + 1, 0)
+        assert.True(t, ok)
+        assert.Equal(t, seconds * time.Second, delay)
+    }
+}
+
+func TestExponentialReconnectPolicyNoMax(t *testing.T) {
+    policy := NewExponentialReconnectPolicy(time.Second, 0, 2, 0)
+
+    for i, seconds := range []time.Duration{1, 2, 4, 8} {
+        delay, _ := policy.NextDelay(i + 1, 0)
+        assert.Equal(t, seconds * time.Second, delay)
+    }
+
+    delay, _ := policy.NextDelay(1000, 0)
+    assert.Greater(t, delay, time.Duration(0))
+
+    // no 0s delays for a missing initial
+    policy = NewExponentialReconnectPolicy(0, time.Minute, 2, 0)
+    delay, _ = policy.NextDelay(1, 0)
+    assert.Equal(t, time.Second, delay)
+}
+
+func TestExponentialReconnectPolicyJitter(t *testing.T) {
+    randFunc := _reconnectRandFunc
+    defer func() {
+        _reconnectRandFunc = randFunc
+    }()
+
+    policy := NewExponentialReconnectPolicy(10 * time.Second, time.Minute, 2, 0.5)
+
+    _reconnectRandFunc = func() float64 { return 0 }
+    delay, _ := policy.NextDelay(1, 0)
+    assert.Equal(t, 5 * time.Second, delay)
+
+    _reconnectRandFunc = func() float64 { return 0.5 }
+    delay, _ = policy.NextDelay(1, 0)
+    assert.Equal(t, 10 * time.Second, delay)
+
+    _reconnectRandFunc = func() float64 { return 1 }
+    delay, _ = policy.NextDelay(2, 0)
+    assert.Equal(t, 30 * time.Second, delay)
+}
+
+func TestLimitedReconnectPolicy(t *testing.T) {
+    policy := NewLimitedReconnectPolicy(NewConstantReconnectPolicy(time.Second), 3, 0)
+
+    for attempt := 1; attempt <= 3; attempt++ {
+        _, ok := policy.NextDelay(attempt, 0)
+        assert.True(t, ok)
+    }
+
+    _, ok := policy.NextDelay(4, 0)
+    assert.False(t, ok)
+
+    policy = NewLimitedReconnectPolicy(NewConstantReconnectPolicy(4 * time.Second), 0, 10 * time.Second)
+
+    _, ok = policy.NextDelay(1, 0)
+    assert.True(t, ok)
+    _, ok = policy.NextDelay(2, 6 * time.Second)
+    assert.True(t, ok)
+    _, ok = policy.NextDelay(3, 7 * time.Second)
+    assert.False(t, ok)
+}
+
+func triggerForcedClose(conn *FakeAmqpConnection) {
+    conn.TriggerClose(&amqp.Error{
+        Code:       302,
+        Reason:     "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+        Server:     true,
+        Recover:    false,
+    })
+}
+
+func TestAmqpClientReconnectPolicy(t *testing.T) {
+    var reconnectError int32
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        if atomic.LoadInt32(&reconnectError) == 0 {
+            return FakeAmqpDialFunc(dialUrl, dialConfig)
+        } else {
+            return nil, &connectError{}
+        }
+    }
+
+    policy := NewExponentialReconnectPolicy(time.Second, 5 * time.Second, 2, 0)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil, WithReconnectPolicy(policy))
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    atomic.StoreInt32(&reconnectError, 1)
+
+    triggerForcedClose(conn)
+
+    conn.clock.WaitUntilBlock(1)
+    reconnectTimer := conn.clock.GetTimer(0)
+
+    for _, interval := range []time.Duration{1, 2, 4, 5, 5} {
+        rightNow := conn.clock.RightNow()
+        assert.Equal(t, rightNow + int64(interval * time.Second), reconnectTimer.ExpireAt())
+        conn.clock.Advance(interval * time.Second)
+        conn.clock.WaitUntilBlock(1)
+    }
+
+    assert.False(t, client.IsFailed())
+
+    client.Disconnect()
+}
+
+func TestAmqpClientReconnectGiveUp(t *testing.T) {
+    var reconnectError int32
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        if atomic.LoadInt32(&reconnectError) == 0 {
+            return FakeAmqpDialFunc(dialUrl, dialConfig)
+        } else {
+            return nil, &connectError{}
+        }
+    }
+
+    policy := NewLimitedReconnectPolicy(NewConstantReconnectPolicy(time.Second), 2, 0)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil, WithReconnectPolicy(policy))
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    result := publishAsync(client, context.Background(), "hello")
+    conn.WaitChannel().WaitPublished()
+
+    atomic.StoreInt32(&reconnectError, 1)
+
+    triggerForcedClose(conn)
+
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(time.Second)
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(time.Second)
+
+    <- client.loopStopped
+
+    assert.True(t, client.IsFailed())
+
+    assert.ErrorIs(t, <- result, ErrClientFailed)
+
+    channel, err := client.Channel()
+    assert.Nil(t, channel)
+    assert.ErrorIs(t, err, ErrClientFailed)
+
+    err = client.Publish(context.Background(), "exchange_test", "key_test", amqp.Publishing{})
+    assert.ErrorIs(t, err, ErrClientFailed)
+
+    assert.NotNil(t, client.Disconnect())
+}
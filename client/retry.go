@@ -0,0 +1,164 @@
+package client
+
+import (
+    "fmt"
+    "time"
+    "errors"
+    "context"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+const (
+    RetryAttemptsHeader = "x-retry-attempts"
+    RetryErrorHeader    = "x-retry-error"
+)
+
+var (
+    ErrRetryAttempt     = errors.New("amqp: retry attempt out of range")
+)
+
+// AmqpRetry sends failed deliveries of a queue through delay queues and
+// finally to a parking queue.
+//
+// A delivery which fails for the n-th time is published to the retry queue
+// of the n-th delay, a queue without consumers whose message ttl is the
+// delay and which dead letters back to the work queue through the default
+// exchange. After len(delays) failures the delivery is published to the
+// parking queue instead. The retry and parking queues are declared by
+// NewAmqpRetry and again after every reconnect, the work queue itself has
+// to be declared by the caller.
+type AmqpRetry struct {
+    client          *AmqpClient
+    queue           string
+    delays          []time.Duration
+    parkingQueue    string
+}
+
+func NewAmqpRetry(client *AmqpClient, queue string, delays ...time.Duration) (*AmqpRetry, error) {
+    retry := &AmqpRetry{
+        client:         client,
+        queue:          queue,
+        delays:         delays,
+        parkingQueue:   queue + ".parking",
+    }
+
+    if err := client.addTopology(retry.Topology()); err != nil {
+        return nil, err
+    }
+
+    return retry, nil
+}
+
+// RetryQueue returns the retry queue of the attempt-th failure, attempts
+// start at 1 and end at the number of delays.
+func (r *AmqpRetry) RetryQueue(attempt int) (string, error) {
+    if attempt < 1 || attempt > len(r.delays) {
+        return "", ErrRetryAttempt
+    }
+    return r.retryQueue(attempt - 1), nil
+}
+
+func (r *AmqpRetry) retryQueue(i int) string {
+    return fmt.Sprintf("%s.retry.%s", r.queue, r.delays[i])
+}
+
+func (r *AmqpRetry) ParkingQueue() string {
+    return r.parkingQueue
+}
+
+// Topology returns the retry and parking queues.
+func (r *AmqpRetry) Topology() *Topology {
+    topology := &Topology{}
+
+    for i, delay := range r.delays {
+        topology.Queues = append(topology.Queues, QueueSpec{
+            Name:                   r.retryQueue(i),
+            Durable:                true,
+            Args:                   amqp.Table{"x-dead-letter-exchange": ""},
+            DeadLetterRoutingKey:   r.queue,
+            MessageTTL:             delay.Milliseconds(),
+        })
+    }
+
+    topology.Queues = append(topology.Queues, QueueSpec{Name: r.parkingQueue, Durable: true})
+
+    return topology
+}
+
+// RetryAttempts returns how many times delivery has failed before.
+func RetryAttempts(delivery amqp.Delivery) int {
+    attempts, _ := tableInt(delivery.Headers[RetryAttemptsHeader])
+    return int(attempts)
+}
+
+// Handler adapts handler to the worker.Consumer handler like
+// NewAmqpDeliveryHandler. A failed delivery is acked once it is published to
+// the retry or parking queue, it is requeued when that publish fails.
+func (r *AmqpRetry) Handler(handler func(amqp.Delivery) error) func(interface{}) {
+    return func(item interface{}) {
+        delivery, ok := item.(amqp.Delivery)
+
+        if !ok {
+            return
+        }
+
+        err := handler(delivery)
+
+        if err == nil {
+            delivery.Ack(false)
+            return
+        }
+
+        if err := r.Retry(context.Background(), delivery, err); err != nil {
+            r.client.log().Errorf("AmqpRetry %s publish error: %#v", r.queue, err)
+            delivery.Nack(false, true)
+            return
+        }
+
+        delivery.Ack(false)
+    }
+}
+
+// Retry publishes a copy of delivery, which failed with cause, to the next
+// retry queue or to the parking queue. It does not ack delivery, a nil
+// cause leaves out the error header.
+func (r *AmqpRetry) Retry(ctx context.Context, delivery amqp.Delivery, cause error) error {
+    attempts := RetryAttempts(delivery) + 1
+
+    msg := deliveryPublishing(delivery)
+    msg.Headers[RetryAttemptsHeader] = int64(attempts)
+
+    if attempts > len(r.delays) {
+        if cause != nil {
+            msg.Headers[RetryErrorHeader] = cause.Error()
+        }
+        return r.client.Publish(ctx, "", r.parkingQueue, msg)
+    }
+
+    return r.client.Publish(ctx, "", r.retryQueue(attempts - 1), msg)
+}
+
+func deliveryPublishing(delivery amqp.Delivery) amqp.Publishing {
+    headers := amqp.Table{}
+
+    for key, value := range delivery.Headers {
+        headers[key] = value
+    }
+
+    return amqp.Publishing{
+        Headers:            headers,
+        ContentType:        delivery.ContentType,
+        ContentEncoding:    delivery.ContentEncoding,
+        DeliveryMode:       delivery.DeliveryMode,
+        Priority:           delivery.Priority,
+        CorrelationId:      delivery.CorrelationId,
+        ReplyTo:            delivery.ReplyTo,
+        MessageId:          delivery.MessageId,
+        Timestamp:          delivery.Timestamp,
+        Type:               delivery.Type,
+        UserId:             delivery.UserId,
+        AppId:              delivery.AppId,
+        Body:               delivery.Body,
+    }
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+    "time"
+    "errors"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+    txWorker "github.com/serenity-77/bagudung/worker"
+)
+
+
+func TestAmqpRetryTopology(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs", Durable: true}},
+    }))
+
+    retry, err := NewAmqpRetry(client, "jobs", time.Second, time.Minute)
+
+    assert.Nil(t, err)
+    queue, err := retry.RetryQueue(1)
+    assert.Nil(t, err)
+    assert.Equal(t, "jobs.retry.1s", queue)
+
+    queue, _ = retry.RetryQueue(2)
+    assert.Equal(t, "jobs.retry.1m0s", queue)
+
+    for _, attempt := range []int{0, 3} {
+        _, err = retry.RetryQueue(attempt)
+        assert.Equal(t, ErrRetryAttempt, err)
+    }
+    assert.Equal(t, "jobs.parking", retry.ParkingQueue())
+
+    for _, queue := range []string{"jobs.retry.1s", "jobs.retry.1m0s", "jobs.parking"} {
+        assert.True(t, broker.HasQueue(queue), queue)
+    }
+
+    assert.Equal(t, amqp.Table{
+        "x-dead-letter-exchange":       "",
+        "x-dead-letter-routing-key":    "jobs",
+        "x-message-ttl":                int64(1000),
+    }, retry.Topology().Queues[0].args())
+
+    // declared again after reconnecting
+    names := []string{}
+    for _, queue := range client.topology.Queues {
+        names = append(names, queue.Name)
+    }
+    assert.Equal(t, []string{"jobs", "jobs.retry.1s", "jobs.retry.1m0s", "jobs.parking"}, names)
+
+    client.Disconnect()
+}
+
+func TestAmqpRetry(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    broker := NewFakeBroker(clock)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "jobs", Durable: true}},
+    }))
+
+    retry, err := NewAmqpRetry(client, "jobs", time.Second, 10 * time.Second)
+    assert.Nil(t, err)
+
+    attempts := make(chan int, 10)
+
+    worker := txWorker.NewWorker(
+        txWorker.NewProducer(NewAmqpProducerHandler(client, "jobs", nil)),
+        txWorker.NewConsumer(retry.Handler(func(delivery amqp.Delivery) error {
+            attempts <- RetryAttempts(delivery)
+            return errors.New("handler error")
+        }), 1),
+    )
+
+    assert.Nil(t, client.Publish(context.Background(), "", "jobs", amqp.Publishing{
+        Headers:    amqp.Table{"trace": "abc"},
+        Body:       []byte("job"),
+    }))
+
+    assert.Equal(t, 0, <- attempts)
+    assert.Eventually(t, func() bool {
+        return broker.QueueMessages("jobs.retry.1s") == 1
+    }, time.Second, time.Millisecond)
+
+    clock.Advance(999 * time.Millisecond)
+    broker.Expire()
+    assert.Equal(t, 1, broker.QueueMessages("jobs.retry.1s"))
+
+    clock.Advance(time.Millisecond)
+    broker.Expire()
+
+    assert.Equal(t, 1, <- attempts)
+    assert.Eventually(t, func() bool {
+        return broker.QueueMessages("jobs.retry.10s") == 1
+    }, time.Second, time.Millisecond)
+
+    clock.Advance(10 * time.Second)
+    broker.Expire()
+
+    assert.Equal(t, 2, <- attempts)
+    assert.Eventually(t, func() bool {
+        return broker.QueueMessages("jobs.parking") == 1
+    }, time.Second, time.Millisecond)
+
+    parked := make(chan amqp.Delivery, 1)
+
+    parking := txWorker.NewWorker(
+        txWorker.NewProducer(NewAmqpProducerHandler(client, "jobs.parking", nil)),
+        txWorker.NewConsumer(NewAmqpDeliveryHandler(func(delivery amqp.Delivery) error {
+            parked <- delivery
+            return nil
+        }, false), 1),
+    )
+
+    delivery := <- parked
+
+    assert.Equal(t, "job", string(delivery.Body))
+    assert.Equal(t, 3, RetryAttempts(delivery))
+    assert.Equal(t, "handler error", delivery.Headers[RetryErrorHeader])
+    assert.Equal(t, "abc", delivery.Headers["trace"])
+
+    parking.Stop()
+    worker.Stop()
+    client.Disconnect()
+
+    assert.Equal(t, 0, broker.QueueMessages("jobs"))
+    assert.Equal(t, 0, broker.QueueUnacked("jobs"))
+}
+
+func TestAmqpRetryNilCause(t *testing.T) {
+    broker := NewFakeBroker(nil)
+
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil)
+
+    retry, _ := NewAmqpRetry(client, "jobs")
+
+    assert.Nil(t, retry.Retry(context.Background(), amqp.Delivery{Body: []byte("1")}, nil))
+
+    _, channel := fakeBrokerChannel(t, broker)
+    deliveries, _ := channel.Consume("jobs.parking", "", true, false, false, false, nil)
+
+    delivery := <- deliveries
+    assert.Equal(t, "1", string(delivery.Body))
+    assert.Equal(t, amqp.Table{RetryAttemptsHeader: int64(1)}, delivery.Headers)
+
+    client.Disconnect()
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+    "sync"
+    "errors"
+    "context"
+    "strconv"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+const (
+    // DirectReplyTo is the RabbitMQ pseudo queue replies are sent to.
+    DirectReplyTo   = "amq.rabbitmq.reply-to"
+    rpcErrorHeader  = "x-rpc-error"
+)
+
+var (
+    ErrRPCClosed            = errors.New("amqp: rpc client closed")
+    ErrRPCConnectionLost    = errors.New("amqp: rpc connection lost before the reply")
+)
+
+// RPCError is returned by RPCClient.Call when the server handler failed.
+type RPCError struct {
+    Message string
+}
+
+func (e *RPCError) Error() string {
+    return "amqp: rpc handler error: " + e.Message
+}
+
+type rpcResult struct {
+    reply   amqp.Delivery
+    err     error
+}
+
+// RPCClient sends requests with ReplyTo set to DirectReplyTo and matches the
+// replies by correlation id. Requests and replies share one channel, as
+// direct reply-to requires, which is opened again after reconnecting. Calls
+// waiting for a reply when the channel goes away fail with
+// ErrRPCConnectionLost, they are not sent again.
+type RPCClient struct {
+    client      *AmqpClient
+    mu          sync.Mutex
+    channel     IAmqpChannel
+    ready       chan struct{}
+    err         error
+    pending     map[string]chan rpcResult
+    nextId      uint64
+    stop        chan struct{}
+    stopped     chan struct{}
+}
+
+func NewRPCClient(client *AmqpClient) *RPCClient {
+    rpc := &RPCClient{
+        client:     client,
+        ready:      make(chan struct{}),
+        pending:    make(map[string]chan rpcResult),
+        stop:       make(chan struct{}),
+        stopped:    make(chan struct{}),
+    }
+    go rpc.replyLoop()
+    return rpc
+}
+
+// Call publishes msg and waits for the reply until ctx is done. The
+// CorrelationId and ReplyTo fields of msg are overwritten.
+func (r *RPCClient) Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+    channel, id, result, err := r.register(ctx)
+
+    if err != nil {
+        return amqp.Delivery{}, err
+    }
+
+    msg.CorrelationId = id
+    msg.ReplyTo = DirectReplyTo
+
+    if err := channel.PublishWithContext(ctx, exchange, key, false, false, msg); err != nil {
+        r.forget(id)
+        if errors.Is(err, amqp.ErrClosed) {
+            err = ErrRPCConnectionLost
+        }
+        return amqp.Delivery{}, err
+    }
+
+    select {
+    case res := <- result:
+        return res.reply, res.err
+    case <- ctx.Done():
+        r.forget(id)
+        return amqp.Delivery{}, ctx.Err()
+    }
+}
+
+// register waits for the reply channel and adds a pending call on it.
+func (r *RPCClient) register(ctx context.Context) (IAmqpChannel, string, chan rpcResult, error) {
+    for {
+        r.mu.Lock()
+
+        if r.err != nil {
+            r.mu.Unlock()
+            return nil, "", nil, r.err
+        }
+
+        if r.channel != nil {
+            r.nextId++
+            id := strconv.FormatUint(r.nextId, 10)
+            result := make(chan rpcResult, 1)
+            r.pending[id] = result
+            channel := r.channel
+            r.mu.Unlock()
+            return channel, id, result, nil
+        }
+
+        ready := r.ready
+        r.mu.Unlock()
+
+        select {
+        case <- ready:
+        case <- ctx.Done():
+            return nil, "", nil, ctx.Err()
+        }
+    }
+}
+
+func (r *RPCClient) forget(id string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    delete(r.pending, id)
+}
+
+// Pending returns the number of calls waiting for a reply.
+func (r *RPCClient) Pending() int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return len(r.pending)
+}
+
+// Close fails the pending calls with ErrRPCClosed.
+func (r *RPCClient) Close() {
+    close(r.stop)
+    <- r.stopped
+}
+
+func (r *RPCClient) replyLoop() {
+    defer close(r.stopped)
+
+    for {
+        var replies <- chan amqp.Delivery
+
+        channel, gen, err := r.client.channelGen()
+
+        if err == nil {
+            replies, err = channel.Consume(DirectReplyTo, "", true, false, false, false, nil)
+            if err != nil {
+                channel.Close()
+            }
+        }
+
+        if errors.Is(err, ErrClientFailed) || errors.Is(err, ErrClientClosed) {
+            r.shutdown(err)
+            <- r.stop
+            return
+        }
+
+        if err != nil {
+            r.client.log().Errorf("RPCClient reply channel error: %#v", err)
+            select {
+            case <- r.client.waitReconnect(gen):
+                continue
+            case <- r.stop:
+                r.shutdown(ErrRPCClosed)
+                return
+            }
+        }
+
+        r.mu.Lock()
+        r.channel = channel
+        close(r.ready)
+        r.mu.Unlock()
+
+        if !r.receive(channel, replies) {
+            r.shutdown(ErrRPCClosed)
+            return
+        }
+
+        r.mu.Lock()
+        r.channel = nil
+        r.ready = make(chan struct{})
+        r.failPending(ErrRPCConnectionLost)
+        r.mu.Unlock()
+    }
+}
+
+// receive returns false when the client is closed and true when the
+// replies channel is closed.
+func (r *RPCClient) receive(channel IAmqpChannel, replies <- chan amqp.Delivery) bool {
+    for {
+        select {
+        case reply, ok := <- replies:
+            if !ok {
+                return true
+            }
+            r.reply(reply)
+        case <- r.stop:
+            channel.Close()
+            return false
+        }
+    }
+}
+
+func (r *RPCClient) reply(reply amqp.Delivery) {
+    r.mu.Lock()
+    result, ok := r.pending[reply.CorrelationId]
+    delete(r.pending, reply.CorrelationId)
+    r.mu.Unlock()
+
+    if !ok {
+        return
+    }
+
+    if message, ok := reply.Headers[rpcErrorHeader].(string); ok {
+        result <- rpcResult{reply, &RPCError{message}}
+    } else {
+        result <- rpcResult{reply, nil}
+    }
+}
+
+// shutdown fails the pending and the future calls with err.
+func (r *RPCClient) shutdown(err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    if r.channel == nil {
+        close(r.ready)
+    }
+
+    r.err = err
+    r.channel = nil
+    r.failPending(err)
+}
+
+// failPending must be called with r.mu held.
+func (r *RPCClient) failPending(err error) {
+    for id, result := range r.pending {
+        result <- rpcResult{err: err}
+        delete(r.pending, id)
+    }
+}
+
+
+// RPCHandler returns the reply for request. When it returns an error the
+// reply carries the error message and Call returns it as *RPCError.
+type RPCHandler func(ctx context.Context, request amqp.Delivery) (amqp.Publishing, error)
+
+// RPCServer consumes queue and publishes the handler reply to the ReplyTo
+// of each request. Requests are handled one at a time and acked after the
+// reply is published. The handler context is cancelled by Stop.
+type RPCServer struct {
+    client      *AmqpClient
+    queue       string
+    handler     RPCHandler
+    ctx         context.Context
+    cancel      context.CancelFunc
+    stopped     chan struct{}
+}
+
+func NewRPCServer(client *AmqpClient, queue string, handler RPCHandler) *RPCServer {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    server := &RPCServer{
+        client:     client,
+        queue:      queue,
+        handler:    handler,
+        ctx:        ctx,
+        cancel:     cancel,
+        stopped:    make(chan struct{}),
+    }
+
+    go server.serveLoop()
+
+    return server
+}
+
+func (s *RPCServer) Stop() {
+    s.cancel()
+    <- s.stopped
+}
+
+func (s *RPCServer) serveLoop() {
+    defer close(s.stopped)
+
+    for {
+        var requests <- chan amqp.Delivery
+
+        channel, gen, err := s.client.channelGen()
+
+        if err == nil {
+            requests, err = channel.Consume(s.queue, "", false, false, false, false, nil)
+            if err != nil {
+                channel.Close()
+            }
+        }
+
+        if errors.Is(err, ErrClientFailed) || errors.Is(err, ErrClientClosed) {
+            <- s.ctx.Done()
+            return
+        }
+
+        if err != nil {
+            s.client.log().Errorf("RPCServer consume %s error: %#v", s.queue, err)
+            select {
+            case <- s.client.waitReconnect(gen):
+                continue
+            case <- s.ctx.Done():
+                return
+            }
+        }
+
+        if !s.serve(channel, requests) {
+            return
+        }
+    }
+}
+
+// serve returns false when the server is stopped and true when the
+// requests channel is closed.
+func (s *RPCServer) serve(channel IAmqpChannel, requests <- chan amqp.Delivery) bool {
+    for {
+        select {
+        case request, ok := <- requests:
+            if !ok {
+                return true
+            }
+            s.handle(channel, request)
+        case <- s.ctx.Done():
+            channel.Close()
+            return false
+        }
+    }
+}
+
+func (s *RPCServer) handle(channel IAmqpChannel, request amqp.Delivery) {
+    reply, err := s.handler(s.ctx, request)
+
+    if err != nil {
+        reply = amqp.Publishing{
+            Headers: amqp.Table{rpcErrorHeader: err.Error()},
+        }
+    }
+
+    if request.ReplyTo != "" {
+        reply.CorrelationId = request.CorrelationId
+        if err := channel.PublishWithContext(s.ctx, "", request.ReplyTo, false, false, reply); err != nil {
+            s.client.log().Errorf("RPCServer reply to %s error: %#v", request.ReplyTo, err)
+            request.Nack(false, true)
+            return
+        }
+    }
+
+    request.Ack(false)
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "context"
+    "strings"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+func newRPCTestClient(t *testing.T, broker *FakeBroker) *AmqpClient {
+    client, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, broker.Dial, nil, WithTopology(&Topology{
+        Queues: []QueueSpec{{Name: "rpc"}},
+    }))
+    assert.Nil(t, err)
+    return client
+}
+
+func upperHandler(ctx context.Context, request amqp.Delivery) (amqp.Publishing, error) {
+    if string(request.Body) == "fail" {
+        return amqp.Publishing{}, errors.New("bad request")
+    }
+    return amqp.Publishing{Body: []byte(strings.ToUpper(string(request.Body)))}, nil
+}
+
+func TestRPCCall(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    client := newRPCTestClient(t, broker)
+
+    server := NewRPCServer(client, "rpc", upperHandler)
+    rpc := NewRPCClient(client)
+
+    var wg sync.WaitGroup
+
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            body := fmt.Sprintf("request %d", i)
+            reply, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte(body)})
+            assert.Nil(t, err)
+            assert.Equal(t, strings.ToUpper(body), string(reply.Body))
+        }(i)
+    }
+
+    wg.Wait()
+
+    assert.Equal(t, 0, rpc.Pending())
+    assert.Equal(t, 0, broker.QueueMessages("rpc"))
+    assert.Equal(t, 0, broker.QueueUnacked("rpc"))
+
+    _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("fail")})
+
+    var rpcError *RPCError
+    assert.True(t, errors.As(err, &rpcError))
+    assert.Equal(t, "bad request", rpcError.Message)
+
+    rpc.Close()
+    server.Stop()
+    client.Disconnect()
+}
+
+func TestRPCCallTimeout(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    client := newRPCTestClient(t, broker)
+    rpc := NewRPCClient(client)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+
+    _, err := rpc.Call(ctx, "", "rpc", amqp.Publishing{Body: []byte("ping")})
+
+    assert.ErrorIs(t, err, context.DeadlineExceeded)
+    assert.Equal(t, 0, rpc.Pending())
+    assert.Equal(t, 1, broker.QueueMessages("rpc"))
+
+    // a late reply is dropped
+    server := NewRPCServer(client, "rpc", upperHandler)
+
+    assert.Eventually(t, func() bool {
+        return broker.QueueMessages("rpc") + broker.QueueUnacked("rpc") == 0
+    }, time.Second, time.Millisecond)
+
+    reply, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("ping")})
+    assert.Nil(t, err)
+    assert.Equal(t, "PING", string(reply.Body))
+
+    server.Stop()
+    rpc.Close()
+    client.Disconnect()
+}
+
+func TestRPCConnectionLost(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    broker := NewFakeBroker(clock)
+    client := newRPCTestClient(t, broker)
+    events := client.NotifyEvent(make(chan AmqpEvent, 100))
+    rpc := NewRPCClient(client)
+
+    errs := make(chan error, 1)
+
+    go func() {
+        _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("ping")})
+        errs <- err
+    }()
+
+    assert.Eventually(t, func() bool {
+        return rpc.Pending() == 1
+    }, time.Second, time.Millisecond)
+
+    broker.DropConnections(nil)
+
+    assert.ErrorIs(t, <- errs, ErrRPCConnectionLost)
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(2 * time.Second)
+    waitEvent(events, EventConnected)
+
+    server := NewRPCServer(client, "rpc", upperHandler)
+
+    reply, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("pong")})
+    assert.Nil(t, err)
+    assert.Equal(t, "PONG", string(reply.Body))
+
+    server.Stop()
+    rpc.Close()
+    client.Disconnect()
+}
+
+func TestRPCClientClose(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    client := newRPCTestClient(t, broker)
+    rpc := NewRPCClient(client)
+
+    errs := make(chan error, 1)
+
+    go func() {
+        _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("ping")})
+        errs <- err
+    }()
+
+    assert.Eventually(t, func() bool {
+        return rpc.Pending() == 1
+    }, time.Second, time.Millisecond)
+
+    rpc.Close()
+
+    assert.ErrorIs(t, <- errs, ErrRPCClosed)
+
+    _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{})
+    assert.ErrorIs(t, err, ErrRPCClosed)
+
+    client.Disconnect()
+}
+
+func TestRPCClientDisconnected(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    client := newRPCTestClient(t, broker)
+    rpc := NewRPCClient(client)
+
+    errs := make(chan error, 1)
+
+    go func() {
+        _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{Body: []byte("ping")})
+        errs <- err
+    }()
+
+    assert.Eventually(t, func() bool {
+        return rpc.Pending() == 1
+    }, time.Second, time.Millisecond)
+
+    client.Disconnect()
+
+    assert.ErrorIs(t, <- errs, ErrRPCConnectionLost)
+
+    _, err := rpc.Call(context.Background(), "", "rpc", amqp.Publishing{})
+    assert.ErrorIs(t, err, ErrClientClosed)
+
+    rpc.Close()
+}
+
+func TestFakeBrokerDirectReplyTo(t *testing.T) {
+    broker := NewFakeBroker(nil)
+    _, channel := fakeBrokerChannel(t, broker)
+
+    err := channel.PublishWithContext(context.Background(), "", "rpc", false, false, amqp.Publishing{ReplyTo: DirectReplyTo})
+    assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+
+    _, channel = fakeBrokerChannel(t, broker)
+
+    _, err = channel.Consume(DirectReplyTo, "", false, false, false, false, nil)
+    assert.Equal(t, amqp.PreconditionFailed, err.(*amqp.Error).Code)
+}
@@ -0,0 +1,265 @@
+package client
+
+import (
+    "os"
+    "fmt"
+    "math"
+    "strings"
+    "encoding/json"
+    "path/filepath"
+    "gopkg.in/yaml.v3"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+type ExchangeSpec struct {
+    Name        string      `json:"name" yaml:"name"`
+    Kind        string      `json:"kind" yaml:"kind"`
+    Durable     bool        `json:"durable" yaml:"durable"`
+    AutoDelete  bool        `json:"auto_delete" yaml:"auto_delete"`
+    Internal    bool        `json:"internal" yaml:"internal"`
+    Args        amqp.Table  `json:"args" yaml:"args"`
+}
+
+// QueueSpec declares a queue. The dead letter, ttl and max length fields
+// are shortcuts for the matching x- arguments and take precedence over Args.
+type QueueSpec struct {
+    Name                    string      `json:"name" yaml:"name"`
+    Durable                 bool        `json:"durable" yaml:"durable"`
+    AutoDelete              bool        `json:"auto_delete" yaml:"auto_delete"`
+    Exclusive               bool        `json:"exclusive" yaml:"exclusive"`
+    Args                    amqp.Table  `json:"args" yaml:"args"`
+    DeadLetterExchange      string      `json:"dead_letter_exchange" yaml:"dead_letter_exchange"`
+    DeadLetterRoutingKey    string      `json:"dead_letter_routing_key" yaml:"dead_letter_routing_key"`
+    MessageTTL              int64       `json:"message_ttl" yaml:"message_ttl"`
+    MaxLength               int64       `json:"max_length" yaml:"max_length"`
+}
+
+type BindingSpec struct {
+    Queue       string      `json:"queue" yaml:"queue"`
+    Exchange    string      `json:"exchange" yaml:"exchange"`
+    Key         string      `json:"key" yaml:"key"`
+    Args        amqp.Table  `json:"args" yaml:"args"`
+}
+
+// Topology is the set of exchanges, queues and bindings a service depends
+// on. They are declared in that order.
+type Topology struct {
+    Exchanges   []ExchangeSpec  `json:"exchanges" yaml:"exchanges"`
+    Queues      []QueueSpec     `json:"queues" yaml:"queues"`
+    Bindings    []BindingSpec   `json:"bindings" yaml:"bindings"`
+}
+
+// TopologyError tells which declaration failed.
+type TopologyError struct {
+    Kind    string
+    Name    string
+    Err     error
+}
+
+func (e *TopologyError) Error() string {
+    return fmt.Sprintf("amqp: declare %s %q: %s", e.Kind, e.Name, e.Err)
+}
+
+func (e *TopologyError) Unwrap() error {
+    return e.Err
+}
+
+func WithTopology(topology *Topology) AmqpClientOption {
+    return func(c *AmqpClient) {
+        c.topology = topology
+    }
+}
+
+func ParseTopologyJSON(data []byte) (*Topology, error) {
+    topology := &Topology{}
+    if err := json.Unmarshal(data, topology); err != nil {
+        return nil, err
+    }
+    topology.normalize()
+    return topology, nil
+}
+
+func ParseTopologyYAML(data []byte) (*Topology, error) {
+    topology := &Topology{}
+    if err := yaml.Unmarshal(data, topology); err != nil {
+        return nil, err
+    }
+    topology.normalize()
+    return topology, nil
+}
+
+// LoadTopologyFile reads a .json, .yaml or .yml topology file.
+func LoadTopologyFile(path string) (*Topology, error) {
+    data, err := os.ReadFile(path)
+
+    if err != nil {
+        return nil, err
+    }
+
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        return ParseTopologyJSON(data)
+    case ".yaml", ".yml":
+        return ParseTopologyYAML(data)
+    }
+
+    return nil, fmt.Errorf("amqp: unknown topology file format %q", path)
+}
+
+// Declare declares the topology on channel and stops at the first error,
+// the channel is closed by the broker in that case.
+func (t *Topology) Declare(channel IAmqpChannel) error {
+    for _, exchange := range t.Exchanges {
+        if err := channel.ExchangeDeclare(exchange.Name, exchange.Kind, exchange.Durable, exchange.AutoDelete, exchange.Internal, false, exchange.Args); err != nil {
+            return &TopologyError{"exchange", exchange.Name, err}
+        }
+    }
+
+    for _, queue := range t.Queues {
+        if _, err := channel.QueueDeclare(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, false, queue.args()); err != nil {
+            return &TopologyError{"queue", queue.Name, err}
+        }
+    }
+
+    for _, binding := range t.Bindings {
+        if err := channel.QueueBind(binding.Queue, binding.Key, binding.Exchange, false, binding.Args); err != nil {
+            return &TopologyError{"binding", binding.Queue + " <- " + binding.Exchange + ":" + binding.Key, err}
+        }
+    }
+
+    return nil
+}
+
+func (t *Topology) declareOn(conn IAmqpConnection) error {
+    channel, err := conn.Channel()
+
+    if err != nil {
+        return err
+    }
+
+    defer channel.Close()
+
+    return t.Declare(channel)
+}
+
+// DeclareTopology declares topology on a new channel of the current
+// connection. Use WithTopology to have it declared after every reconnect.
+func (c *AmqpClient) DeclareTopology(topology *Topology) error {
+    channel, err := c.Channel()
+
+    if err != nil {
+        return err
+    }
+
+    defer channel.Close()
+
+    return topology.Declare(channel)
+}
+
+// addTopology declares topology now and, together with the WithTopology
+// one, after every reconnect.
+func (c *AmqpClient) addTopology(topology *Topology) error {
+    if err := c.DeclareTopology(topology); err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.topology = c.topology.merge(topology)
+
+    return nil
+}
+
+// merge returns a new topology with the declarations of t followed by the
+// ones of other, t may be nil.
+func (t *Topology) merge(other *Topology) *Topology {
+    merged := &Topology{}
+
+    if t != nil {
+        merged.Exchanges = append(merged.Exchanges, t.Exchanges...)
+        merged.Queues = append(merged.Queues, t.Queues...)
+        merged.Bindings = append(merged.Bindings, t.Bindings...)
+    }
+
+    merged.Exchanges = append(merged.Exchanges, other.Exchanges...)
+    merged.Queues = append(merged.Queues, other.Queues...)
+    merged.Bindings = append(merged.Bindings, other.Bindings...)
+
+    return merged
+}
+
+func (q *QueueSpec) args() amqp.Table {
+    args := amqp.Table{}
+
+    for key, value := range q.Args {
+        args[key] = value
+    }
+
+    if q.DeadLetterExchange != "" {
+        args["x-dead-letter-exchange"] = q.DeadLetterExchange
+    }
+
+    if q.DeadLetterRoutingKey != "" {
+        args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+    }
+
+    if q.MessageTTL > 0 {
+        args["x-message-ttl"] = q.MessageTTL
+    }
+
+    if q.MaxLength > 0 {
+        args["x-max-length"] = q.MaxLength
+    }
+
+    if len(args) == 0 {
+        return nil
+    }
+
+    return args
+}
+
+// normalize turns whole float64 arguments, as decoded from JSON, into
+// int64 which is what the broker expects for numeric x- arguments.
+func (t *Topology) normalize() {
+    for _, exchange := range t.Exchanges {
+        normalizeTable(exchange.Args)
+    }
+    for _, queue := range t.Queues {
+        normalizeTable(queue.Args)
+    }
+    for _, binding := range t.Bindings {
+        normalizeTable(binding.Args)
+    }
+}
+
+func normalizeTable(table amqp.Table) {
+    for key, value := range table {
+        switch v := value.(type) {
+        case float64:
+            if v == math.Trunc(v) {
+                table[key] = int64(v)
+            }
+        case int:
+            table[key] = int64(v)
+        case map[string]interface{}:
+            nested := amqp.Table(v)
+            normalizeTable(nested)
+            table[key] = nested
+        }
+    }
+}
+
+// tableInt reads an integer table value, whatever its width.
+func tableInt(value interface{}) (int64, bool) {
+    switch v := value.(type) {
+    case int:
+        return int64(v), true
+    case int32:
+        return int64(v), true
+    case int64:
+        return v, true
+    }
+    return 0, false
+}
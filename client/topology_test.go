@@ -0,0 +1,273 @@
+package client
+
+import (
+    "os"
+    "time"
+    "errors"
+    "testing"
+    "path/filepath"
+    "github.com/stretchr/testify/assert"
+    amqp "github.com/rabbitmq/amqp091-go"
+)
+
+
+func testTopology() *Topology {
+    return &Topology{
+        Exchanges: []ExchangeSpec{
+            {Name: "orders", Kind: "topic", Durable: true},
+            {Name: "orders.dlx", Kind: "fanout", Durable: true},
+        },
+        Queues: []QueueSpec{
+            {Name: "orders.created", Durable: true, DeadLetterExchange: "orders.dlx"},
+            {Name: "orders.dead", Durable: true},
+        },
+        Bindings: []BindingSpec{
+            {Queue: "orders.created", Exchange: "orders", Key: "order.created"},
+            {Queue: "orders.dead", Exchange: "orders.dlx"},
+        },
+    }
+}
+
+var testTopologyDeclared = []string{
+    "exchange:orders:topic",
+    "exchange:orders.dlx:fanout",
+    "queue:orders.created",
+    "queue:orders.dead",
+    "bind:orders.created:orders:order.created",
+    "bind:orders.dead:orders.dlx:",
+}
+
+func TestTopologyDeclare(t *testing.T) {
+    channel := NewFakeAmqpChannel()
+
+    assert.Nil(t, testTopology().Declare(channel))
+    assert.Equal(t, testTopologyDeclared, channel.Declared())
+}
+
+func TestTopologyDeclareError(t *testing.T) {
+    declareError := &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED", Server: true, Recover: true}
+
+    channel := NewFakeAmqpChannel()
+    channel.declareErr = func(declaration string) error {
+        if declaration == "queue:orders.dead" {
+            return declareError
+        }
+        return nil
+    }
+
+    err := testTopology().Declare(channel)
+
+    var topologyError *TopologyError
+    assert.True(t, errors.As(err, &topologyError))
+    assert.Equal(t, "queue", topologyError.Kind)
+    assert.Equal(t, "orders.dead", topologyError.Name)
+    assert.ErrorIs(t, err, declareError)
+    assert.Equal(t, `amqp: declare queue "orders.dead": ` + declareError.Error(), err.Error())
+
+    assert.Equal(t, testTopologyDeclared[:3], channel.Declared())
+}
+
+func TestQueueSpecArgs(t *testing.T) {
+    queue := QueueSpec{Name: "orders"}
+    assert.Nil(t, queue.args())
+
+    queue = QueueSpec{
+        Name:                   "orders",
+        Args:                   amqp.Table{"x-queue-type": "quorum", "x-message-ttl": int64(1)},
+        DeadLetterExchange:     "orders.dlx",
+        DeadLetterRoutingKey:   "dead",
+        MessageTTL:             60000,
+        MaxLength:              1000,
+    }
+
+    assert.Equal(t, amqp.Table{
+        "x-queue-type":                 "quorum",
+        "x-dead-letter-exchange":       "orders.dlx",
+        "x-dead-letter-routing-key":    "dead",
+        "x-message-ttl":                int64(60000),
+        "x-max-length":                 int64(1000),
+    }, queue.args())
+
+    // spec args are left untouched
+    assert.Equal(t, int64(1), queue.Args["x-message-ttl"])
+}
+
+const testTopologyJSON = `{
+    "exchanges": [{"name": "orders", "kind": "topic", "durable": true}],
+    "queues": [{
+        "name": "orders.created",
+        "durable": true,
+        "dead_letter_exchange": "orders.dlx",
+        "message_ttl": 5000,
+        "args": {"x-max-priority": 10, "x-queue-mode": "lazy", "x-ratio": 0.5}
+    }],
+    "bindings": [{"queue": "orders.created", "exchange": "orders", "key": "order.#"}]
+}`
+
+const testTopologyYAML = `
+exchanges:
+  - name: orders
+    kind: topic
+    durable: true
+queues:
+  - name: orders.created
+    durable: true
+    dead_letter_exchange: orders.dlx
+    message_ttl: 5000
+    args:
+      x-max-priority: 10
+      x-queue-mode: lazy
+      x-ratio: 0.5
+bindings:
+  - queue: orders.created
+    exchange: orders
+    key: order.#
+`
+
+func assertParsedTopology(t *testing.T, topology *Topology) {
+    assert.Equal(t, []ExchangeSpec{{Name: "orders", Kind: "topic", Durable: true}}, topology.Exchanges)
+    assert.Equal(t, []QueueSpec{{
+        Name:                   "orders.created",
+        Durable:                true,
+        DeadLetterExchange:     "orders.dlx",
+        MessageTTL:             5000,
+        Args:                   amqp.Table{"x-max-priority": int64(10), "x-queue-mode": "lazy", "x-ratio": 0.5},
+    }}, topology.Queues)
+    assert.Equal(t, []BindingSpec{{Queue: "orders.created", Exchange: "orders", Key: "order.#"}}, topology.Bindings)
+}
+
+func TestParseTopology(t *testing.T) {
+    topology, err := ParseTopologyJSON([]byte(testTopologyJSON))
+    assert.Nil(t, err)
+    assertParsedTopology(t, topology)
+
+    topology, err = ParseTopologyYAML([]byte(testTopologyYAML))
+    assert.Nil(t, err)
+    assertParsedTopology(t, topology)
+
+    _, err = ParseTopologyJSON([]byte("{"))
+    assert.NotNil(t, err)
+}
+
+func TestLoadTopologyFile(t *testing.T) {
+    dir := t.TempDir()
+
+    files := map[string]string{
+        "topology.json":    testTopologyJSON,
+        "topology.yaml":    testTopologyYAML,
+        "topology.YML":     testTopologyYAML,
+    }
+
+    for name, content := range files {
+        path := filepath.Join(dir, name)
+        assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+        topology, err := LoadTopologyFile(path)
+        assert.Nil(t, err)
+        assertParsedTopology(t, topology)
+    }
+
+    path := filepath.Join(dir, "topology.toml")
+    assert.Nil(t, os.WriteFile(path, []byte(""), 0644))
+
+    _, err := LoadTopologyFile(path)
+    assert.NotNil(t, err)
+
+    _, err = LoadTopologyFile(filepath.Join(dir, "missing.json"))
+    assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAmqpClientTopology(t *testing.T) {
+    conns := make(chan *FakeAmqpConnection, 10)
+    var declareError error
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        conn := NewFakeAmqpConnection()
+        err := declareError
+        conn.declareErr = func(declaration string) error {
+            if declaration == "queue:orders.dead" {
+                return err
+            }
+            return nil
+        }
+        conns <- conn
+        return conn, nil
+    }
+
+    client, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil, WithTopology(testTopology()))
+
+    assert.Nil(t, err)
+
+    events := client.NotifyEvent(make(chan AmqpEvent, 10))
+
+    conn := <- conns
+    channel := conn.WaitChannel()
+
+    assert.Equal(t, testTopologyDeclared, channel.Declared())
+    assert.True(t, channel.closed)
+
+    conn.WaitNotifyClose()
+    triggerForcedClose(conn)
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(2 * time.Second)
+
+    conn = <- conns
+    conn.WaitNotifyClose()
+
+    assert.Equal(t, testTopologyDeclared, conn.WaitChannel().Declared())
+
+    declareError = &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED", Server: true, Recover: true}
+
+    triggerForcedClose(conn)
+    conn.clock.WaitUntilBlock(1)
+    conn.clock.Advance(2 * time.Second)
+
+    conn = <- conns
+    conn.WaitNotifyClose()
+
+    for event := range events {
+        if event.Type == EventTopologyFailed {
+            assert.ErrorIs(t, event.Err, declareError)
+            break
+        }
+    }
+
+    // the connection is kept even though the topology failed
+    assert.Equal(t, EventConnected, (<- events).Type)
+    assert.Same(t, conn, client.conn)
+
+    client.Disconnect()
+}
+
+func TestAmqpClientTopologyConnectError(t *testing.T) {
+    declareError := &amqp.Error{Code: 406, Reason: "PRECONDITION_FAILED", Server: true, Recover: true}
+
+    conns := make(chan *FakeAmqpConnection, 1)
+
+    dialFn := func(dialUrl string, dialConfig *amqp.Config) (IAmqpConnection, error) {
+        conn := NewFakeAmqpConnection()
+        conn.declareErr = func(declaration string) error {
+            return declareError
+        }
+        conns <- conn
+        return conn, nil
+    }
+
+    client, err := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, dialFn, nil, WithTopology(testTopology()))
+
+    assert.Nil(t, client)
+    assert.ErrorIs(t, err, declareError)
+
+    conn := <- conns
+    assert.True(t, conn.closed)
+}
+
+func TestAmqpClientDeclareTopology(t *testing.T) {
+    client, _ := NewAmqpClientDialFunc(_DIAL_URL_TEST, nil, FakeAmqpDialFunc, nil)
+
+    conn := client.conn.(*FakeAmqpConnection)
+    conn.WaitNotifyClose()
+
+    assert.Nil(t, client.DeclareTopology(testTopology()))
+    assert.Equal(t, testTopologyDeclared, conn.WaitChannel().Declared())
+}
@@ -21,6 +21,7 @@ type ITimerImpl interface {
 
 type IClock interface {
     Timer(time.Duration)    *Timer
+    Now()                   time.Time
 }
 
 type FakeClock struct {
@@ -59,6 +60,10 @@ func (fc *FakeClock) RightNow() int64 {
     return atomic.LoadInt64(&fc.rightNow)
 }
 
+func (fc *FakeClock) Now() time.Time {
+    return time.Unix(0, fc.RightNow())
+}
+
 func (fc *FakeClock) GetTimer(index int) *FakeTimer {
     return fc.timers[index]
 }
@@ -186,3 +191,7 @@ func (rc *RealClock) Timer(d time.Duration) *Timer {
     timer := &Timer{rt, rt.C}
     return timer
 }
+
+func (rc *RealClock) Now() time.Time {
+    return time.Now()
+}
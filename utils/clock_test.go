@@ -255,3 +255,14 @@ func TestFakeTimerWaitStop(t *testing.T) {
 
     wg.Wait()
 }
+
+func TestFakeClockNow(t *testing.T) {
+    fc := NewFakeClock()
+
+    now := fc.Now()
+    assert.Equal(t, fc.RightNow(), now.UnixNano())
+
+    fc.Advance(3 * time.Second)
+
+    assert.Equal(t, 3 * time.Second, fc.Now().Sub(now))
+}
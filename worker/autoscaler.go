@@ -0,0 +1,157 @@
+package worker
+
+import (
+    "time"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+var _ IResizableConsumer = (*Consumer)(nil)
+
+// IResizableConsumer is a consumer the Autoscaler can resize, a zero
+// Latency means it is not known yet.
+type IResizableConsumer interface {
+    WorkerNum()     int
+    Latency()       time.Duration
+    Resize(int)
+}
+
+// IPendingQueue is a queue the Autoscaler can watch.
+type IPendingQueue interface {
+    Pending()   int
+}
+
+// AutoscalerConfig tells when the Autoscaler resizes. The expected wait of a
+// pending item is the number of pending items times the handler latency
+// divided by the workers. Above UpWait workers are added, below DownWait one
+// is retired, the gap between them keeps the consumer from flapping.
+type AutoscalerConfig struct {
+    Min             int
+    Max             int
+    // Interval between the checks, a second by default.
+    Interval        time.Duration
+    // UpWait is a second and DownWait a quarter of UpWait by default.
+    UpWait          time.Duration
+    DownWait        time.Duration
+    // UpCooldown and DownCooldown are the time since the last resize before
+    // scaling up or down again.
+    UpCooldown      time.Duration
+    DownCooldown    time.Duration
+    Clock           txUtils.IClock
+}
+
+// Autoscaler resizes a consumer between Min and Max workers as the queue
+// pending items and the handler latency say. It does not scale before the
+// consumer knows its latency. Stop it before stopping the Worker, a
+// ConsumerOf ignores the resizes once it is stopping.
+type Autoscaler struct {
+    consumer    IResizableConsumer
+    queue       IPendingQueue
+    config      AutoscalerConfig
+    lastResize  time.Time
+    stop        chan struct{}
+    stopWait    chan struct{}
+}
+
+func NewAutoscaler(consumer IResizableConsumer, queue IPendingQueue, config AutoscalerConfig) *Autoscaler {
+    if config.Min <= 0 {
+        config.Min = 1
+    }
+
+    if config.Max < config.Min {
+        config.Max = config.Min
+    }
+
+    if config.Interval <= 0 {
+        config.Interval = time.Second
+    }
+
+    if config.UpWait <= 0 {
+        config.UpWait = time.Second
+    }
+
+    if config.DownWait <= 0 {
+        config.DownWait = config.UpWait / 4
+    }
+
+    if config.Clock == nil {
+        config.Clock = txUtils.NewRealClock()
+    }
+
+    return &Autoscaler{
+        consumer:   consumer,
+        queue:      queue,
+        config:     config,
+        stop:       make(chan struct{}),
+        stopWait:   make(chan struct{}),
+    }
+}
+
+// Start brings the consumer within Min and Max and checks it every
+// Interval until Stop.
+func (a *Autoscaler) Start() {
+    workers := a.consumer.WorkerNum()
+
+    if workers < a.config.Min {
+        a.resize(a.config.Min)
+    } else if workers > a.config.Max {
+        a.resize(a.config.Max)
+    }
+
+    go a.scaleLoop()
+}
+
+func (a *Autoscaler) Stop() {
+    close(a.stop)
+    <- a.stopWait
+}
+
+func (a *Autoscaler) scaleLoop() {
+    defer close(a.stopWait)
+
+    intervalTimer := a.config.Clock.Timer(a.config.Interval)
+
+    for {
+        select {
+        case <- intervalTimer.C:
+            a.scale()
+            intervalTimer.Reset(a.config.Interval)
+        case <- a.stop:
+            intervalTimer.Stop()
+            return
+        }
+    }
+}
+
+func (a *Autoscaler) scale() {
+    latency := a.consumer.Latency()
+
+    // a backlog of handlers which did not return yet looks like none
+    if latency == 0 {
+        return
+    }
+
+    workers := a.consumer.WorkerNum()
+    backlog := time.Duration(a.queue.Pending()) * latency
+    wait := backlog / time.Duration(workers)
+    since := a.config.Clock.Now().Sub(a.lastResize)
+
+    switch {
+    case wait > a.config.UpWait && workers < a.config.Max && since >= a.config.UpCooldown:
+        // enough workers to get back under UpWait at once
+        target := int((backlog + a.config.UpWait - 1) / a.config.UpWait)
+
+        if target > a.config.Max {
+            target = a.config.Max
+        }
+
+        a.resize(target)
+    case wait < a.config.DownWait && workers > a.config.Min && since >= a.config.DownCooldown:
+        a.resize(workers - 1)
+    }
+}
+
+func (a *Autoscaler) resize(workers int) {
+    a.consumer.Resize(workers)
+    a.lastResize = a.config.Clock.Now()
+}
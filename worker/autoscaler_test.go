@@ -0,0 +1,130 @@
+package worker
+
+import (
+    "time"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+type pendingQueue struct {
+    pending int
+}
+
+func (q *pendingQueue) Pending() int {
+    return q.pending
+}
+
+func TestAutoscaler(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := &pendingQueue{}
+
+    consumer := NewConsumer(func(data interface{}) {}, 10)
+    consumer.latency = 100 * time.Millisecond
+
+    scaler := NewAutoscaler(consumer, queue, AutoscalerConfig{
+        Min:            2,
+        Max:            8,
+        UpCooldown:     time.Second,
+        DownCooldown:   5 * time.Second,
+        Clock:          clock,
+    })
+
+    // brought within Max at once
+    scaler.Start()
+    assert.Equal(t, 8, consumer.WorkerNum())
+
+    clock.WaitUntilBlock(1)
+
+    // the timer is reset once scaled
+    check := func(pending int, expectedWorkerNum int) {
+        queue.pending = pending
+        clock.Advance(time.Second)
+        clock.WaitUntilBlock(1)
+        assert.Equal(t, expectedWorkerNum, consumer.WorkerNum())
+    }
+
+    // waits 8 * 100ms / 8 = 100ms, between DownWait and UpWait
+    check(8, 8)
+
+    // nothing pending, down by one after the cooldown only
+    check(0, 8)
+    check(0, 8)
+    check(0, 8)
+    check(0, 7)
+    check(0, 7)
+
+    // 100 * 100ms needs 10 workers to wait a second, capped at Max
+    check(100, 8)
+
+    check(0, 8)
+
+    scaler.Stop()
+
+    assert.Equal(t, 8, consumer.WorkerNum())
+}
+
+func TestAutoscalerUp(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := &pendingQueue{}
+
+    consumer := NewConsumer(func(data interface{}) {}, 1)
+    consumer.latency = 100 * time.Millisecond
+
+    scaler := NewAutoscaler(consumer, queue, AutoscalerConfig{
+        Min:            1,
+        Max:            8,
+        UpCooldown:     2 * time.Second,
+        Clock:          clock,
+    })
+
+    scaler.Start()
+    assert.Equal(t, 1, consumer.WorkerNum())
+
+    clock.WaitUntilBlock(1)
+    queue.pending = 30
+    clock.Advance(time.Second)
+    clock.WaitUntilBlock(1)
+
+    // 30 * 100ms waits a second on 3 workers
+    assert.Equal(t, 3, consumer.WorkerNum())
+
+    queue.pending = 60
+    clock.Advance(time.Second)
+    clock.WaitUntilBlock(1)
+
+    assert.Equal(t, 3, consumer.WorkerNum())
+
+    clock.Advance(time.Second)
+    clock.WaitUntilBlock(1)
+
+    assert.Equal(t, 6, consumer.WorkerNum())
+
+    scaler.Stop()
+}
+
+func TestAutoscalerNoLatency(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := &pendingQueue{pending: 100}
+
+    consumer := NewConsumer(func(data interface{}) {}, 4)
+
+    scaler := NewAutoscaler(consumer, queue, AutoscalerConfig{Min: 1, Max: 8, Clock: clock})
+    scaler.Start()
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(time.Second)
+    clock.WaitUntilBlock(1)
+
+    // no handler returned yet, the backlog is not taken for none
+    assert.Equal(t, 4, consumer.WorkerNum())
+
+    // the first call is the average
+    consumer.observe(time.Second)
+    assert.Equal(t, time.Second, consumer.Latency())
+    consumer.observe(2 * time.Second)
+    assert.Equal(t, time.Second + time.Second / 8, consumer.Latency())
+
+    scaler.Stop()
+}
@@ -2,55 +2,422 @@ package worker
 
 
 import (
+    "time"
     "sync"
+    "context"
+    "runtime/debug"
+    "github.com/sirupsen/logrus"
+    txUtils "github.com/serenity-77/bagudung/utils"
 )
 
 
 var _ IWorkerConsumer = (*Consumer)(nil)
+var _ IWorkerConsumerAborter = (*Consumer)(nil)
 
-type Consumer struct {
-    handler     func(interface{})
+// ConsumerOf handles the queue items on workerNum goroutines. A handler
+// panic is recovered and counts as a failure with a *PanicError. A failed
+// item is handled again as the retry policy says, on the same goroutine,
+// and then passed to the failure handler.
+//
+// AbortConsuming, like the worker context inside a Worker, cancels the
+// context given to the handlers, the items they give up are returned
+// instead of being retried or failed.
+type ConsumerOf[T any] struct {
+    handler     func(context.Context, T) error
     workerNum   int
     stopWg      sync.WaitGroup
+    retry       RetryPolicy
+    failed      func(T, error)
+    clock       txUtils.IClock
+    ctx         context.Context
+    cancel      context.CancelFunc
+    mu          sync.Mutex
+    aborted     []T
+    itemTimeout time.Duration
+    queue       IWorkerQueueConsumerOf[T]
+    quits       []chan struct{}
+    latency     time.Duration
+    observed    bool
+    stopping    bool
+    limits      []func(context.Context, T) error
+}
+
+
+type Consumer = ConsumerOf[interface{}]
+
+type consumerOptionsOf[T any] struct {
+    itemTimeout time.Duration
+    clock       txUtils.IClock
+    limits      []func(context.Context, T) error
+}
+
+// ConsumerOptionOf is an option of a ConsumerOf[T], the options taking the
+// items are typed by T so they only fit the consumers of T.
+type ConsumerOptionOf[T any] func(*consumerOptionsOf[T])
+
+type ConsumerOption = ConsumerOptionOf[interface{}]
+
+// WithItemTimeoutOf gives every handler call a context with a deadline of
+// timeout. A call running out of time fails with the context error and is
+// retried like any other failure.
+func WithItemTimeoutOf[T any](timeout time.Duration) ConsumerOptionOf[T] {
+    return func(o *consumerOptionsOf[T]) {
+        o.itemTimeout = timeout
+    }
+}
+
+// WithClockOf drives the retry delays and the latency with clock instead of
+// the real clock.
+func WithClockOf[T any](clock txUtils.IClock) ConsumerOptionOf[T] {
+    return func(o *consumerOptionsOf[T]) {
+        o.clock = clock
+    }
+}
+
+// WithRateLimitOf makes every handler call, retries included, wait for
+// limiter first. It can be given more than once, like with a limiter shared
+// by several consumers and one of their own.
+func WithRateLimitOf[T any](limiter IRateLimiter) ConsumerOptionOf[T] {
+    return func(o *consumerOptionsOf[T]) {
+        o.limits = append(o.limits, func(ctx context.Context, item T) error {
+            return limiter.Wait(ctx)
+        })
+    }
+}
+
+// WithKeyRateLimitOf is WithRateLimitOf with a limit for every key of the
+// items. A panic of key fails the item like a handler panic.
+func WithKeyRateLimitOf[T any](limiter *KeyedRateLimiter, key KeyFuncOf[T]) ConsumerOptionOf[T] {
+    return func(o *consumerOptionsOf[T]) {
+        o.limits = append(o.limits, func(ctx context.Context, item T) error {
+            return limiter.Wait(ctx, key(item))
+        })
+    }
+}
+
+// WithItemTimeout is WithItemTimeoutOf for the untyped API.
+func WithItemTimeout(timeout time.Duration) ConsumerOption {
+    return WithItemTimeoutOf[interface{}](timeout)
+}
+
+// WithClock is WithClockOf for the untyped API.
+func WithClock(clock txUtils.IClock) ConsumerOption {
+    return WithClockOf[interface{}](clock)
+}
+
+// WithRateLimit is WithRateLimitOf for the untyped API.
+func WithRateLimit(limiter IRateLimiter) ConsumerOption {
+    return WithRateLimitOf[interface{}](limiter)
+}
+
+// WithKeyRateLimit is WithKeyRateLimitOf for the untyped API.
+func WithKeyRateLimit(limiter *KeyedRateLimiter, key KeyFunc) ConsumerOption {
+    return WithKeyRateLimitOf[interface{}](limiter, key)
 }
 
 
 func NewConsumer(handler func(interface{}), workerNum int) *Consumer {
+    return NewConsumerOf[interface{}](handler, workerNum)
+}
+
+// NewRetryConsumer is NewRetryConsumerOf for the untyped API.
+func NewRetryConsumer(handler func(interface{}) error, workerNum int, retry RetryPolicy, failed func(interface{}, error), opts ...ConsumerOption) *Consumer {
+    return NewRetryConsumerOf[interface{}](handler, workerNum, retry, failed, opts...)
+}
+
+// NewContextConsumer is NewContextConsumerOf for the untyped API.
+func NewContextConsumer(handler func(context.Context, interface{}) error, workerNum int, retry RetryPolicy, failed func(interface{}, error), opts ...ConsumerOption) *Consumer {
+    return NewContextConsumerOf[interface{}](handler, workerNum, retry, failed, opts...)
+}
+
+func NewConsumerOf[T any](handler func(T), workerNum int) *ConsumerOf[T] {
+    return NewRetryConsumerOf[T](func(item T) error {
+        handler(item)
+        return nil
+    }, workerNum, nil, nil)
+}
+
+// NewRetryConsumerOf takes a handler returning an error. A nil retry
+// handles every item once, a nil failed logs the failures.
+func NewRetryConsumerOf[T any](handler func(T) error, workerNum int, retry RetryPolicy, failed func(T, error), opts ...ConsumerOptionOf[T]) *ConsumerOf[T] {
+    return NewContextConsumerOf[T](func(ctx context.Context, item T) error {
+        return handler(item)
+    }, workerNum, retry, failed, opts...)
+}
+
+// NewContextConsumerOf is NewRetryConsumerOf with a handler taking the
+// context cancelled by AbortConsuming and, inside a Worker, with the worker
+// context.
+func NewContextConsumerOf[T any](handler func(context.Context, T) error, workerNum int, retry RetryPolicy, failed func(T, error), opts ...ConsumerOptionOf[T]) *ConsumerOf[T] {
+    options := consumerOptionsOf[T]{}
+
+    for _, opt := range opts {
+        opt(&options)
+    }
+
+    if options.clock == nil {
+        options.clock = txUtils.NewRealClock()
+    }
+
     if workerNum <= 0 {
         workerNum = 1
     }
 
-    consumer := &Consumer{
+    if failed == nil {
+        failed = func(item T, err error) {
+            logrus.Errorf("worker: item %v failed: %s", item, err)
+        }
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    consumer := &ConsumerOf[T]{
         handler: handler,
         workerNum: workerNum,
+        retry: retry,
+        failed: failed,
+        clock: options.clock,
+        ctx: ctx,
+        cancel: cancel,
+        itemTimeout: options.itemTimeout,
+        limits: options.limits,
     }
 
     return consumer
 }
 
+// DeadLetterTo returns a failure handler putting the failed items to queue.
+func DeadLetterTo[T any](queue IWorkerQueueProducerOf[T]) func(T, error) {
+    return func(item T, err error) {
+        queue.Put(item)
+    }
+}
+
+
+// WorkerNum returns the number of workers handling items at the same time.
+func (c *ConsumerOf[T]) WorkerNum() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.workerNum
+}
+
+// Latency returns the moving average of the handler call durations, zero
+// until the first call returned.
+func (c *ConsumerOf[T]) Latency() time.Duration {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.latency
+}
+
+// bindContext makes the handler context a child of the worker context.
+func (c *ConsumerOf[T]) bindContext(ctx context.Context) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.cancel()
+    c.ctx, c.cancel = context.WithCancel(ctx)
+}
+
+func (c *ConsumerOf[T]) StartConsuming(queue IWorkerQueueConsumerOf[T]) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    // already aborted, nobody would collect the items taken
+    if c.ctx.Err() != nil {
+        return
+    }
+
+    c.queue = queue
+
+    for len(c.quits) < c.workerNum {
+        c.startWorker()
+    }
+}
+
+// Resize sets the number of workers. Before StartConsuming it only sets the
+// number to start with and once StopConsuming is called it does nothing
+// else either. A retired worker finishes the item it handles first.
+func (c *ConsumerOf[T]) Resize(workerNum int) {
+    if workerNum <= 0 {
+        workerNum = 1
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.workerNum = workerNum
+
+    if c.queue == nil || c.stopping || c.ctx.Err() != nil {
+        return
+    }
+
+    for len(c.quits) < c.workerNum {
+        c.startWorker()
+    }
 
-func (c *Consumer) StartConsuming(queue IWorkerQueueConsumer) {
-    for i := 0; i < c.workerNum; i++ {
-        c.stopWg.Add(1)
-        go c.consumingLoop(queue)
+    for len(c.quits) > c.workerNum {
+        last := len(c.quits) - 1
+        close(c.quits[last])
+        c.quits = c.quits[:last]
     }
 }
 
-func (c *Consumer) StopConsuming() {
+func (c *ConsumerOf[T]) startWorker() {
+    quit := make(chan struct{})
+    c.quits = append(c.quits, quit)
+    c.stopWg.Add(1)
+    go c.consumingLoop(c.queue, quit)
+}
+
+func (c *ConsumerOf[T]) StopConsuming() {
+    c.mu.Lock()
+    c.stopping = true
+    c.mu.Unlock()
+
     c.stopWg.Wait()
 }
 
+// AbortConsuming cancels the handlers and stops taking items without
+// waiting for the queue to be closed. It returns the items taken but not
+// handled once the handlers returned, so a handler ignoring its context
+// holds it up, Worker.Shutdown does not wait past its context for it.
+func (c *ConsumerOf[T]) AbortConsuming() []T {
+    c.mu.Lock()
+    c.cancel()
+    c.mu.Unlock()
+
+    c.stopWg.Wait()
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
 
-func (c *Consumer) consumingLoop(queue IWorkerQueueConsumer) {
+    aborted := c.aborted
+    c.aborted = nil
+
+    return aborted
+}
+
+func (c *ConsumerOf[T]) abandon(item T) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.aborted = append(c.aborted, item)
+}
+
+
+func (c *ConsumerOf[T]) consumingLoop(queue IWorkerQueueConsumerOf[T], quit chan struct{}) {
     defer c.stopWg.Done()
 
-    for {
+    // select picks at random, an aborted loop must not take another item
+    for c.ctx.Err() == nil {
         select {
+        case <- quit:
+            return
         case item, ok := <- queue.Get():
             if !ok {
                 return
             }
-            c.handler(item)
+            if c.ctx.Err() != nil {
+                c.abandon(item)
+                return
+            }
+            c.handle(item)
+        case <- c.ctx.Done():
+            return
         }
     }
 }
+
+func (c *ConsumerOf[T]) handle(item T) {
+    for attempt := 1; ; attempt++ {
+        // only an abort ends a wait early, unless a key func panicked
+        if err := c.limit(item); err != nil {
+            if c.ctx.Err() != nil {
+                c.abandon(item)
+            } else {
+                c.failed(item, err)
+            }
+            return
+        }
+
+        start := c.clock.Now()
+        err := c.call(item)
+        c.observe(c.clock.Now().Sub(start))
+
+        if err == nil {
+            return
+        }
+
+        if c.ctx.Err() != nil {
+            c.abandon(item)
+            return
+        }
+
+        if c.retry == nil {
+            c.failed(item, err)
+            return
+        }
+
+        delay, ok := c.retry.NextDelay(attempt)
+
+        if !ok {
+            c.failed(item, err)
+            return
+        }
+
+        timer := c.clock.Timer(delay)
+
+        select {
+        case <- timer.C:
+        case <- c.ctx.Done():
+            timer.Stop()
+            c.abandon(item)
+            return
+        }
+    }
+}
+
+func (c *ConsumerOf[T]) limit(item T) (err error) {
+    defer func() {
+        if value := recover(); value != nil {
+            err = &PanicError{value, debug.Stack()}
+        }
+    }()
+
+    for _, limit := range c.limits {
+        if err := limit(c.ctx, item); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// observe adds a call duration to the moving average, weighting it 1/8.
+// The first one starts the average.
+func (c *ConsumerOf[T]) observe(d time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if !c.observed {
+        c.latency = d
+        c.observed = true
+        return
+    }
+
+    c.latency += (d - c.latency) / 8
+}
+
+func (c *ConsumerOf[T]) call(item T) (err error) {
+    defer func() {
+        if value := recover(); value != nil {
+            err = &PanicError{value, debug.Stack()}
+        }
+    }()
+
+    if c.itemTimeout <= 0 {
+        return c.handler(c.ctx, item)
+    }
+
+    ctx, cancel := context.WithTimeout(c.ctx, c.itemTimeout)
+    defer cancel()
+
+    return c.handler(ctx, item)
+}
@@ -2,8 +2,12 @@ package worker
 
 import (
     "sync"
+    "context"
+    "time"
+    "errors"
     "testing"
     "github.com/stretchr/testify/assert"
+    txUtils "github.com/serenity-77/bagudung/utils"
 )
 
 func assertConsumer(t *testing.T, c *Consumer, expectedWorkerNum int) {
@@ -16,6 +20,7 @@ func assertConsumer(t *testing.T, c *Consumer, expectedWorkerNum int) {
 func TestConsumer(t *testing.T) {
     consumer := NewConsumer(func(data interface{}){}, 3)
     assertConsumer(t, consumer, 3)
+    assert.Equal(t, 3, consumer.WorkerNum())
 }
 
 type testData1 struct {
@@ -113,3 +118,232 @@ func TestConsumerStopConsuming(t *testing.T) {
 
     consumer.StopConsuming()
 }
+
+func TestConsumerRetry(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := NewQueue()
+    attempts := 0
+    handled := make(chan int, 1)
+
+    consumer := NewRetryConsumer(func(data interface{}) error {
+        attempts++
+        if attempts < 3 {
+            return errors.New("not yet")
+        }
+        handled <- attempts
+        return nil
+    }, 1, NewConstantRetryPolicy(time.Second, 3), nil, WithClock(clock))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+
+    for i := 0; i < 2; i++ {
+        clock.WaitUntilBlock(1)
+        clock.Advance(time.Second)
+    }
+
+    assert.Equal(t, 3, <- handled)
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestConsumerRetryExhausted(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := NewQueue()
+    dead := NewQueue()
+
+    consumer := NewRetryConsumer(func(data interface{}) error {
+        panic("boom")
+    }, 1, NewConstantRetryPolicy(time.Second, 2), DeadLetterTo[interface{}](dead), WithClock(clock))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(time.Second)
+
+    assert.Equal(t, 1, <- dead.Get())
+
+    queue.Close()
+    consumer.StopConsuming()
+    dead.Close()
+}
+
+func TestConsumerPanic(t *testing.T) {
+    queue := NewQueueOf[int]()
+    failed := make(chan error, 1)
+
+    consumer := NewRetryConsumerOf[int](func(item int) error {
+        var m map[string]int
+        m["x"] = item
+        return nil
+    }, 1, nil, func(item int, err error) {
+        failed <- err
+    })
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+    queue.Put(2)
+
+    for i := 0; i < 2; i++ {
+        var panicErr *PanicError
+        assert.True(t, errors.As(<- failed, &panicErr))
+        assert.NotEmpty(t, panicErr.Stack)
+    }
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestConsumerAbortConsuming(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := NewQueue()
+
+    consumer := NewRetryConsumer(func(data interface{}) error {
+        return errors.New("failed")
+    }, 1, NewConstantRetryPolicy(time.Second, 3), nil, WithClock(clock))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+
+    // 1 waits for its retry
+    clock.WaitUntilBlock(1)
+
+    assert.Equal(t, []interface{}{1}, consumer.AbortConsuming())
+
+    // an aborted consumer does not start again
+    consumer.StartConsuming(queue)
+    queue.Put(3)
+    assert.Equal(t, 3, <- queue.Get())
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestConsumerItemTimeout(t *testing.T) {
+    queue := NewQueueOf[int]()
+    failed := make(chan error, 1)
+
+    consumer := NewContextConsumerOf[int](func(ctx context.Context, item int) error {
+        _, ok := ctx.Deadline()
+        assert.True(t, ok)
+        <- ctx.Done()
+        return ctx.Err()
+    }, 1, nil, func(item int, err error) {
+        failed <- err
+    }, WithItemTimeoutOf[int](time.Millisecond))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+
+    assert.Equal(t, context.DeadlineExceeded, <- failed)
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestConsumerResize(t *testing.T) {
+    queue := NewQueueOf[int]()
+    started := make(chan int, 3)
+    release := make(chan struct{})
+
+    consumer := NewConsumerOf[int](func(item int) {
+        started <- item
+        <- release
+    }, 1)
+
+    // before starting only the number changes
+    consumer.Resize(0)
+    assert.Equal(t, 1, consumer.WorkerNum())
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(1)
+    queue.Put(2)
+    queue.Put(3)
+
+    <- started
+    consumer.Resize(3)
+    assert.Equal(t, 3, consumer.WorkerNum())
+
+    // all three are handled at the same time
+    <- started
+    <- started
+
+    consumer.Resize(1)
+    assert.Equal(t, 1, consumer.WorkerNum())
+    assert.Equal(t, 1, len(consumer.quits))
+
+    close(release)
+
+    queue.Put(4)
+    assert.Equal(t, 4, <- started)
+
+    queue.Close()
+    consumer.StopConsuming()
+
+    // a stopped consumer does not start workers again
+    consumer.Resize(2)
+    assert.Equal(t, 1, len(consumer.quits))
+}
+
+func TestConsumerRateLimit(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := NewQueueOf[keyedItem]()
+    handled := make(chan keyedItem, 3)
+
+    keyed := NewKeyedRateLimiter(1, time.Second, 1, clock)
+
+    consumer := NewContextConsumerOf[keyedItem](func(ctx context.Context, item keyedItem) error {
+        handled <- item
+        return nil
+    }, 1, nil, nil, WithRateLimitOf[keyedItem](NewRateLimiter(10, time.Second, 10, clock)), WithKeyRateLimitOf(keyed, keyOf), WithClockOf[keyedItem](clock))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(keyedItem{"a", 1})
+    queue.Put(keyedItem{"a", 2})
+
+    assert.Equal(t, keyedItem{"a", 1}, <- handled)
+
+    // the second of "a" waits for its key
+    clock.WaitUntilBlock(1)
+    assert.Equal(t, 0, len(handled))
+
+    clock.Advance(time.Second)
+    assert.Equal(t, keyedItem{"a", 2}, <- handled)
+
+    assert.Equal(t, time.Second, keyed.Stats().WaitTime)
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestConsumerKeyFuncPanic(t *testing.T) {
+    queue := NewQueueOf[keyedItem]()
+    failed := make(chan error, 1)
+
+    consumer := NewContextConsumerOf[keyedItem](func(ctx context.Context, item keyedItem) error {
+        return nil
+    }, 1, nil, func(item keyedItem, err error) {
+        failed <- err
+    }, WithKeyRateLimitOf(NewKeyedRateLimiter(1, time.Second, 1, nil), func(item keyedItem) string {
+        panic("boom")
+    }))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(keyedItem{"a", 1})
+
+    var panicErr *PanicError
+    assert.True(t, errors.As(<- failed, &panicErr))
+
+    queue.Close()
+    consumer.StopConsuming()
+}
@@ -0,0 +1,209 @@
+package worker
+
+import (
+    "sync"
+    "time"
+    "context"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+var _ IRateLimiter = (*RateLimiter)(nil)
+
+type IRateLimiter interface {
+    Wait(context.Context) error
+}
+
+// RateLimiterStats tells how long the callers of Wait were held up. The
+// time of a cancelled wait is counted in full.
+type RateLimiterStats struct {
+    Calls       uint64
+    Waits       uint64
+    WaitTime    time.Duration
+    MaxWait     time.Duration
+}
+
+func (s *RateLimiterStats) add(delay time.Duration) {
+    s.Calls++
+
+    if delay <= 0 {
+        return
+    }
+
+    s.Waits++
+    s.WaitTime += delay
+
+    if delay > s.MaxWait {
+        s.MaxWait = delay
+    }
+}
+
+// RateLimiter is a token bucket of burst tokens refilled at limit per per,
+// kept as the time the bucket is full again, like a leaky bucket meter.
+// Every Wait takes its token up front, so the callers go in the order they
+// called.
+type RateLimiter struct {
+    interval    time.Duration
+    burst       int
+    clock       txUtils.IClock
+    mu          sync.Mutex
+    full        time.Time
+    stats       RateLimiterStats
+}
+
+// NewRateLimiter allows limit calls every per with bursts of up to burst
+// calls, burst is at least one. A nil clock is the real clock.
+func NewRateLimiter(limit int, per time.Duration, burst int, clock txUtils.IClock) *RateLimiter {
+    if limit <= 0 {
+        limit = 1
+    }
+
+    if burst <= 0 {
+        burst = 1
+    }
+
+    if clock == nil {
+        clock = txUtils.NewRealClock()
+    }
+
+    return &RateLimiter{
+        interval:   per / time.Duration(limit),
+        burst:      burst,
+        clock:      clock,
+    }
+}
+
+// Wait waits for a token or until ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return waitDelay(ctx, l.clock, l.reserve())
+}
+
+func (l *RateLimiter) Stats() RateLimiterStats {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.stats
+}
+
+// reserve takes a token and returns how long to wait for it.
+func (l *RateLimiter) reserve() time.Duration {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := l.clock.Now()
+
+    if l.full.Before(now) {
+        l.full = now
+    }
+
+    delay := l.full.Add(-time.Duration(l.burst - 1) * l.interval).Sub(now)
+    l.full = l.full.Add(l.interval)
+
+    l.stats.add(delay)
+
+    return delay
+}
+
+func (l *RateLimiter) idle(now time.Time) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return !l.full.After(now)
+}
+
+func waitDelay(ctx context.Context, clock txUtils.IClock, delay time.Duration) error {
+    if delay <= 0 {
+        return nil
+    }
+
+    timer := clock.Timer(delay)
+
+    select {
+    case <- timer.C:
+        return nil
+    case <- ctx.Done():
+        timer.Stop()
+        return ctx.Err()
+    }
+}
+
+
+// KeyedRateLimiter gives every key a RateLimiter of its own. Keys with a
+// full bucket are forgotten as the number of keys grows.
+type KeyedRateLimiter struct {
+    limit       int
+    per         time.Duration
+    burst       int
+    clock       txUtils.IClock
+    mu          sync.Mutex
+    limiters    map[string]*RateLimiter
+    sweepAt     int
+    stats       RateLimiterStats
+}
+
+const keyedRateLimiterSweep = 64
+
+// NewKeyedRateLimiter takes the arguments of NewRateLimiter for every key.
+func NewKeyedRateLimiter(limit int, per time.Duration, burst int, clock txUtils.IClock) *KeyedRateLimiter {
+    if clock == nil {
+        clock = txUtils.NewRealClock()
+    }
+
+    return &KeyedRateLimiter{
+        limit:      limit,
+        per:        per,
+        burst:      burst,
+        clock:      clock,
+        limiters:   make(map[string]*RateLimiter),
+        sweepAt:    keyedRateLimiterSweep,
+    }
+}
+
+// Wait waits for a token of key or until ctx is done.
+func (k *KeyedRateLimiter) Wait(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    k.mu.Lock()
+    delay := k.limiter(key).reserve()
+    k.stats.add(delay)
+    k.mu.Unlock()
+
+    return waitDelay(ctx, k.clock, delay)
+}
+
+// Stats returns the stats of all keys together.
+func (k *KeyedRateLimiter) Stats() RateLimiterStats {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    return k.stats
+}
+
+func (k *KeyedRateLimiter) limiter(key string) *RateLimiter {
+    if limiter, ok := k.limiters[key]; ok {
+        return limiter
+    }
+
+    if len(k.limiters) >= k.sweepAt {
+        now := k.clock.Now()
+
+        for key, limiter := range k.limiters {
+            if limiter.idle(now) {
+                delete(k.limiters, key)
+            }
+        }
+
+        k.sweepAt = 2 * len(k.limiters)
+
+        if k.sweepAt < keyedRateLimiterSweep {
+            k.sweepAt = keyedRateLimiterSweep
+        }
+    }
+
+    limiter := NewRateLimiter(k.limit, k.per, k.burst, k.clock)
+    k.limiters[key] = limiter
+
+    return limiter
+}
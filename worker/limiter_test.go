@@ -0,0 +1,85 @@
+package worker
+
+import (
+    "time"
+    "context"
+    "strconv"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+func TestRateLimiter(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    limiter := NewRateLimiter(2, time.Second, 2, clock)
+
+    // the burst goes at once
+    assert.Nil(t, limiter.Wait(context.Background()))
+    assert.Nil(t, limiter.Wait(context.Background()))
+
+    done := make(chan error)
+
+    go func() {
+        done <- limiter.Wait(context.Background())
+    }()
+
+    clock.WaitUntilBlock(1)
+    assert.Equal(t, clock.RightNow() + int64(500 * time.Millisecond), clock.GetTimer(0).ExpireAt())
+
+    clock.Advance(500 * time.Millisecond)
+    assert.Nil(t, <- done)
+
+    assert.Equal(t, RateLimiterStats{
+        Calls:      3,
+        Waits:      1,
+        WaitTime:   500 * time.Millisecond,
+        MaxWait:    500 * time.Millisecond,
+    }, limiter.Stats())
+
+    // the next one waits for the token after
+    ctx, cancel := context.WithCancel(context.Background())
+
+    go func() {
+        done <- limiter.Wait(ctx)
+    }()
+
+    clock.WaitUntilBlock(1)
+    cancel()
+
+    assert.Equal(t, context.Canceled, <- done)
+    assert.Equal(t, context.Canceled, limiter.Wait(ctx))
+    assert.Equal(t, time.Second, limiter.Stats().WaitTime)
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    limiter := NewKeyedRateLimiter(1, time.Second, 1, clock)
+
+    assert.Nil(t, limiter.Wait(context.Background(), "a"))
+    assert.Nil(t, limiter.Wait(context.Background(), "b"))
+
+    done := make(chan error)
+
+    go func() {
+        done <- limiter.Wait(context.Background(), "a")
+    }()
+
+    clock.WaitUntilBlock(1)
+    clock.Advance(time.Second)
+    assert.Nil(t, <- done)
+
+    stats := limiter.Stats()
+    assert.Equal(t, uint64(3), stats.Calls)
+    assert.Equal(t, uint64(1), stats.Waits)
+
+    for i := 2; i < keyedRateLimiterSweep; i++ {
+        limiter.Wait(context.Background(), strconv.Itoa(i))
+    }
+
+    // once their buckets are full the keys are forgotten
+    clock.Advance(time.Second)
+    limiter.Wait(context.Background(), "c")
+
+    assert.Equal(t, 1, len(limiter.limiters))
+}
@@ -0,0 +1,183 @@
+package worker
+
+import (
+    "sync"
+    "context"
+    "hash/fnv"
+)
+
+
+var _ IWorkerConsumer = (*PartitionedConsumer)(nil)
+var _ IWorkerConsumerAborter = (*PartitionedConsumer)(nil)
+
+// KeyFuncOf returns the key of an item, items with the same key are handled
+// in order.
+type KeyFuncOf[T any] func(T) string
+
+type KeyFunc = KeyFuncOf[interface{}]
+
+// PartitionedConsumerOf hashes the key of every item to one of its
+// partitions. A partition is a ConsumerOf with a single worker and its own
+// queue, so the items of a key are handled one after the other, retries
+// included, while the other partitions go on. A partition queue holds one
+// item, the items of a busy partition wait in the Worker queue.
+type PartitionedConsumerOf[T any] struct {
+    key         KeyFuncOf[T]
+    partitions  []*ConsumerOf[T]
+    queues      []*QueueOf[T]
+    stopWg      sync.WaitGroup
+    ctx         context.Context
+    cancel      context.CancelFunc
+    mu          sync.Mutex
+    aborted     []T
+    started     bool
+}
+
+type PartitionedConsumer = PartitionedConsumerOf[interface{}]
+
+
+// NewPartitionedConsumer is NewPartitionedConsumerOf for the untyped API.
+func NewPartitionedConsumer(handler func(context.Context, interface{}) error, key KeyFunc, partitionNum int, retry RetryPolicy, failed func(interface{}, error), opts ...ConsumerOption) *PartitionedConsumer {
+    return NewPartitionedConsumerOf[interface{}](handler, key, partitionNum, retry, failed, opts...)
+}
+
+// NewPartitionedConsumerOf takes the arguments of NewContextConsumerOf, with
+// the number of partitions as the number of workers.
+func NewPartitionedConsumerOf[T any](handler func(context.Context, T) error, key KeyFuncOf[T], partitionNum int, retry RetryPolicy, failed func(T, error), opts ...ConsumerOptionOf[T]) *PartitionedConsumerOf[T] {
+    if partitionNum <= 0 {
+        partitionNum = 1
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    consumer := &PartitionedConsumerOf[T]{
+        key:        key,
+        partitions: make([]*ConsumerOf[T], partitionNum),
+        queues:     make([]*QueueOf[T], partitionNum),
+        ctx:        ctx,
+        cancel:     cancel,
+    }
+
+    for i := range consumer.partitions {
+        consumer.partitions[i] = NewContextConsumerOf[T](handler, 1, retry, failed, opts...)
+        consumer.queues[i] = NewQueueOf[T](WithCapacity(1, OverflowBlock))
+    }
+
+    return consumer
+}
+
+
+// WorkerNum returns the number of partitions.
+func (c *PartitionedConsumerOf[T]) WorkerNum() int {
+    return len(c.partitions)
+}
+
+func (c *PartitionedConsumerOf[T]) partition(item T) int {
+    hash := fnv.New32a()
+    hash.Write([]byte(c.key(item)))
+    return int(hash.Sum32() % uint32(len(c.partitions)))
+}
+
+func (c *PartitionedConsumerOf[T]) bindContext(ctx context.Context) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.cancel()
+    c.ctx, c.cancel = context.WithCancel(ctx)
+
+    for _, partition := range c.partitions {
+        partition.bindContext(c.ctx)
+    }
+}
+
+func (c *PartitionedConsumerOf[T]) StartConsuming(queue IWorkerQueueConsumerOf[T]) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    // already aborted, nobody would collect the items taken
+    if c.ctx.Err() != nil {
+        return
+    }
+
+    for i, partition := range c.partitions {
+        partition.StartConsuming(c.queues[i])
+    }
+
+    c.started = true
+    c.stopWg.Add(1)
+    go c.dispatchLoop(queue)
+}
+
+// StopConsuming waits until the queue is closed and the partitions handled
+// their items.
+func (c *PartitionedConsumerOf[T]) StopConsuming() {
+    c.stopWg.Wait()
+
+    for _, partition := range c.partitions {
+        partition.StopConsuming()
+    }
+}
+
+// AbortConsuming aborts every partition. It returns the items each of them
+// gave up followed by the items still waiting for it.
+func (c *PartitionedConsumerOf[T]) AbortConsuming() []T {
+    c.mu.Lock()
+    c.cancel()
+    started := c.started
+    c.mu.Unlock()
+
+    c.stopWg.Wait()
+
+    items := []T{}
+
+    for i, partition := range c.partitions {
+        items = append(items, partition.AbortConsuming()...)
+
+        if !started {
+            continue
+        }
+
+        // the partition queue is closed by the dispatch loop
+        for item := range c.queues[i].Get() {
+            items = append(items, item)
+        }
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    items = append(items, c.aborted...)
+    c.aborted = nil
+
+    return items
+}
+
+func (c *PartitionedConsumerOf[T]) dispatchLoop(queue IWorkerQueueConsumerOf[T]) {
+    defer c.stopWg.Done()
+
+    // Close returns once the items are taken, by the partition or by
+    // AbortConsuming, so it must not hold up the loop
+    defer func() {
+        for _, partitionQueue := range c.queues {
+            go partitionQueue.Close()
+        }
+    }()
+
+    for {
+        select {
+        case item, ok := <- queue.Get():
+            if !ok {
+                return
+            }
+            // a full partition is not taking items once aborted
+            if c.ctx.Err() != nil || c.queues[c.partition(item)].putContext(c.ctx, item) != nil {
+                c.mu.Lock()
+                c.aborted = append(c.aborted, item)
+                c.mu.Unlock()
+                return
+            }
+        case <- c.ctx.Done():
+            return
+        }
+    }
+}
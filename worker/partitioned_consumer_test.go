@@ -0,0 +1,132 @@
+package worker
+
+import (
+    "sync"
+    "time"
+    "context"
+    "testing"
+    "github.com/stretchr/testify/assert"
+)
+
+
+type keyedItem struct {
+    key     string
+    value   int
+}
+
+func keyOf(item keyedItem) string {
+    return item.key
+}
+
+func TestPartitionedConsumer(t *testing.T) {
+    queue := NewQueueOf[keyedItem]()
+
+    var mu sync.Mutex
+    handled := map[string][]int{}
+
+    consumer := NewPartitionedConsumerOf[keyedItem](func(ctx context.Context, item keyedItem) error {
+        mu.Lock()
+        defer mu.Unlock()
+        handled[item.key] = append(handled[item.key], item.value)
+        return nil
+    }, keyOf, 4, nil, nil)
+
+    assert.Equal(t, 4, consumer.WorkerNum())
+
+    consumer.StartConsuming(queue)
+
+    for i := 0; i < 100; i++ {
+        for _, key := range []string{"a", "b", "c", "d", "e"} {
+            queue.Put(keyedItem{key, i})
+        }
+    }
+
+    queue.Close()
+    consumer.StopConsuming()
+
+    for _, key := range []string{"a", "b", "c", "d", "e"} {
+        assert.Equal(t, 100, len(handled[key]))
+        for i, value := range handled[key] {
+            assert.Equal(t, i, value)
+        }
+    }
+}
+
+func TestPartitionedConsumerParallel(t *testing.T) {
+    queue := NewQueueOf[keyedItem]()
+    started := make(chan keyedItem, 2)
+    release := make(chan struct{})
+
+    consumer := NewPartitionedConsumerOf[keyedItem](func(ctx context.Context, item keyedItem) error {
+        started <- item
+        <- release
+        return nil
+    }, keyOf, 2, nil, nil)
+
+    // "a" and "b" go to different partitions
+    assert.NotEqual(t, consumer.partition(keyedItem{key: "a"}), consumer.partition(keyedItem{key: "b"}))
+
+    consumer.StartConsuming(queue)
+
+    queue.Put(keyedItem{"a", 1})
+    queue.Put(keyedItem{"a", 2})
+    queue.Put(keyedItem{"b", 1})
+
+    // a blocked "a" does not hold up "b"
+    assert.ElementsMatch(t, []keyedItem{{"a", 1}, {"b", 1}}, []keyedItem{<- started, <- started})
+
+    close(release)
+    assert.Equal(t, keyedItem{"a", 2}, <- started)
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestPartitionedConsumerBackpressure(t *testing.T) {
+    queue := NewQueueOf[keyedItem]()
+    release := make(chan struct{})
+
+    consumer := NewPartitionedConsumerOf[keyedItem](func(ctx context.Context, item keyedItem) error {
+        <- release
+        return nil
+    }, keyOf, 1, nil, nil)
+
+    consumer.StartConsuming(queue)
+
+    for i := 0; i < 5; i++ {
+        queue.Put(keyedItem{"a", i})
+    }
+
+    // one item handled, one in the partition queue and one being put to it
+    assert.Eventually(t, func() bool {
+        return queue.Pending() == 2
+    }, time.Second, time.Millisecond)
+
+    close(release)
+
+    queue.Close()
+    consumer.StopConsuming()
+}
+
+func TestPartitionedConsumerWorkerAbort(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{"a1", "a2", "a3"}, make(chan struct{})}
+    started := make(chan interface{}, 3)
+
+    consumer := NewPartitionedConsumer(func(ctx context.Context, data interface{}) error {
+        started <- data
+        <- ctx.Done()
+        return ctx.Err()
+    }, func(data interface{}) string {
+        return data.(string)[:1]
+    }, 3, nil, nil)
+
+    worker := NewWorker(producer, consumer)
+
+    <- producer.put
+    assert.Equal(t, "a1", <- started)
+
+    items, err := worker.Shutdown(context.Background(), ShutdownAbort)
+
+    assert.Nil(t, err)
+    assert.Equal(t, []interface{}{"a1", "a2", "a3"}, items)
+}
@@ -0,0 +1,194 @@
+package worker
+
+import (
+    "time"
+    "container/heap"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+var _ IWorkerQueue = (*PriorityQueue)(nil)
+var _ IWorkerQueuePriorityProducer = (*PriorityQueue)(nil)
+
+// PriorityQueueOf hands out the items with the highest priority first and
+// items of the same priority in the order they were put. With aging an item
+// gains one priority for every interval it waits, so low priority items are
+// not starved by a steady flow of high priority ones.
+type PriorityQueueOf[T any] struct {
+    queue       chan priorityItem[T]
+    pending     priorityItems[T]
+    waiting     chan T
+    lchan       chan int
+    closeChan   chan struct{}
+    aging       time.Duration
+    clock       txUtils.IClock
+    seq         uint64
+}
+
+type PriorityQueue = PriorityQueueOf[interface{}]
+
+type priorityQueueOptions struct {
+    aging       time.Duration
+    clock       txUtils.IClock
+}
+
+type PriorityQueueOption func(*priorityQueueOptions)
+
+// WithAging makes items gain one priority for every interval they wait,
+// clock defaults to the real clock.
+func WithAging(interval time.Duration, clock txUtils.IClock) PriorityQueueOption {
+    return func(o *priorityQueueOptions) {
+        o.aging = interval
+        o.clock = clock
+    }
+}
+
+func NewPriorityQueue(opts ...PriorityQueueOption) *PriorityQueue {
+    return NewPriorityQueueOf[interface{}](opts...)
+}
+
+func NewPriorityQueueOf[T any](opts ...PriorityQueueOption) *PriorityQueueOf[T] {
+    options := priorityQueueOptions{}
+
+    for _, opt := range opts {
+        opt(&options)
+    }
+
+    q := &PriorityQueueOf[T]{
+        queue:      make(chan priorityItem[T]),
+        waiting:    make(chan T),
+        lchan:      make(chan int),
+        closeChan:  make(chan struct{}),
+        aging:      options.aging,
+        clock:      options.clock,
+    }
+
+    if q.aging > 0 && q.clock == nil {
+        q.clock = txUtils.NewRealClock()
+    }
+
+    go q.queueLoop()
+
+    return q
+}
+
+func (q *PriorityQueueOf[T]) queueLoop() {
+    defer close(q.closeChan)
+    defer close(q.waiting)
+
+    for {
+        if len(q.pending) == 0 {
+            select {
+            case q.lchan <- 0:
+            case item, ok := <- q.queue:
+                if !ok {
+                    return
+                }
+                q.push(item)
+            }
+            continue
+        }
+
+        select {
+        case q.lchan <- len(q.pending):
+        case item, ok := <- q.queue:
+            if !ok {
+                q.finishPending()
+                return
+            }
+            q.push(item)
+        case q.waiting <- q.pending[0].data:
+            heap.Pop(&q.pending)
+        }
+    }
+}
+
+// push orders item by priority or, with aging, by priority less the
+// intervals waited. Both keep their order while waiting, so the heap stays
+// valid.
+func (q *PriorityQueueOf[T]) push(item priorityItem[T]) {
+    q.seq++
+    item.seq = q.seq
+    item.score = int64(item.priority)
+
+    if q.aging > 0 {
+        item.score = int64(item.priority) * int64(q.aging) - q.clock.Now().UnixNano()
+    }
+
+    heap.Push(&q.pending, item)
+}
+
+func (q *PriorityQueueOf[T]) finishPending() {
+    for len(q.pending) > 0 {
+        select {
+        case q.waiting <- q.pending[0].data:
+            heap.Pop(&q.pending)
+        case q.lchan <- len(q.pending):
+        }
+    }
+}
+
+// Put puts data with priority 0.
+func (q *PriorityQueueOf[T]) Put(data T) {
+    q.PutPriority(data, 0)
+}
+
+// PutPriority puts data with priority, higher priorities are taken first.
+func (q *PriorityQueueOf[T]) PutPriority(data T, priority int) {
+    q.queue <- priorityItem[T]{data: data, priority: priority}
+}
+
+func (q *PriorityQueueOf[T]) Get() <- chan T {
+    return q.waiting
+}
+
+func (q *PriorityQueueOf[T]) Pending() int {
+    select {
+    case <- q.closeChan:
+        return len(q.pending)
+    case p := <- q.lchan:
+        return p
+    }
+}
+
+func (q *PriorityQueueOf[T]) Close() {
+    close(q.queue)
+    <- q.closeChan
+}
+
+
+type priorityItem[T any] struct {
+    data        T
+    priority    int
+    score       int64
+    seq         uint64
+}
+
+type priorityItems[T any] []priorityItem[T]
+
+func (p priorityItems[T]) Len() int {
+    return len(p)
+}
+
+func (p priorityItems[T]) Less(i, j int) bool {
+    if p[i].score != p[j].score {
+        return p[i].score > p[j].score
+    }
+    return p[i].seq < p[j].seq
+}
+
+func (p priorityItems[T]) Swap(i, j int) {
+    p[i], p[j] = p[j], p[i]
+}
+
+func (p *priorityItems[T]) Push(x interface{}) {
+    *p = append(*p, x.(priorityItem[T]))
+}
+
+func (p *priorityItems[T]) Pop() interface{} {
+    old := *p
+    item := old[len(old) - 1]
+    old[len(old) - 1] = priorityItem[T]{}
+    *p = old[:len(old) - 1]
+    return item
+}
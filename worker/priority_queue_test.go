@@ -0,0 +1,121 @@
+package worker
+
+import (
+    "time"
+    "testing"
+    "github.com/stretchr/testify/assert"
+    txUtils "github.com/serenity-77/bagudung/utils"
+)
+
+
+func takeQueue(q IWorkerQueue, n int) []interface{} {
+    items := make([]interface{}, n)
+    for i := 0; i < n; i++ {
+        items[i] = <- q.Get()
+    }
+    return items
+}
+
+func TestPriorityQueue(t *testing.T) {
+    q := NewPriorityQueue()
+
+    q.Put("bulk-1")
+    q.PutPriority("urgent-1", 10)
+    q.Put("bulk-2")
+    q.PutPriority("normal-1", 5)
+    q.PutPriority("urgent-2", 10)
+    q.PutPriority("late", -1)
+
+    assert.Equal(t, 6, q.Pending())
+
+    assert.Equal(t, []interface{}{
+        "urgent-1", "urgent-2", "normal-1", "bulk-1", "bulk-2", "late",
+    }, takeQueue(q, 6))
+
+    assert.Equal(t, 0, q.Pending())
+
+    q.Close()
+
+    _, ok := <- q.Get()
+    assert.False(t, ok)
+}
+
+func TestPriorityQueueAging(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    q := NewPriorityQueue(WithAging(time.Minute, clock))
+
+    q.Put("bulk-1")
+    clock.Advance(3 * time.Minute)
+    q.PutPriority("urgent-1", 2)
+    q.PutPriority("urgent-2", 4)
+    q.Put("bulk-2")
+
+    // bulk-1 waited for three priorities
+    assert.Equal(t, []interface{}{"urgent-2", "bulk-1", "urgent-1", "bulk-2"}, takeQueue(q, 4))
+
+    q.Close()
+}
+
+func TestPriorityQueueCloseFinishPending(t *testing.T) {
+    q := NewPriorityQueue()
+
+    q.Put(1)
+    q.PutPriority(2, 1)
+
+    closed := make(chan struct{})
+
+    go func() {
+        q.Close()
+        close(closed)
+    }()
+
+    assert.Equal(t, []interface{}{2, 1}, takeQueue(q, 2))
+
+    <- closed
+
+    _, ok := <- q.Get()
+    assert.False(t, ok)
+    assert.Equal(t, 0, q.Pending())
+}
+
+func TestPriorityQueueWorker(t *testing.T) {
+    q := NewPriorityQueueOf[int]()
+
+    handler := NewIntervalProducerHandlerOf[int](func() []int {
+        return []int{1, 2, 3, 4}
+    }, time.Hour, true)
+
+    producer := NewProducerOf[int](handler, WithPriorityFuncOf(func(item int) int {
+        return item
+    }))
+
+    received := make(chan int, 4)
+    release := make(chan struct{})
+
+    consumer := NewConsumerOf[int](func(item int) {
+        received <- item
+        <- release
+    }, 1)
+
+    worker := NewWorkerQueueOf[int](q, producer, consumer)
+
+    // the first item is taken at once, the others wait in the queue
+    first := <- received
+
+    assert.Eventually(t, func() bool {
+        return q.Pending() == 3
+    }, time.Second, time.Millisecond)
+
+    close(release)
+
+    rest := []int{}
+    for _, item := range []int{4, 3, 2, 1} {
+        if item != first {
+            rest = append(rest, item)
+        }
+    }
+
+    assert.Equal(t, rest, []int{<- received, <- received, <- received})
+
+    worker.Stop()
+}
@@ -2,37 +2,119 @@ package worker
 
 import (
     "time"
+    "context"
     txUtils "github.com/serenity-77/bagudung/utils"
 )
 
 
 var _ IWorkerProducer = (*Producer)(nil)
 
-type IProducerHandler interface {
-    Enqueue(chan <- interface{})
+type IProducerHandlerOf[T any] interface {
+    Enqueue(chan <- T)
     Stop()
 }
 
-type Producer struct {
-    handler     IProducerHandler
-    chanQueue   chan interface{}
+type IProducerHandler = IProducerHandlerOf[interface{}]
+
+// contextBinder is implemented by producers and handlers which take the
+// worker context, the worker binds it before starting them.
+type contextBinder interface {
+    bindContext(context.Context)
+}
+
+type ProducerOf[T any] struct {
+    handler     IProducerHandlerOf[T]
+    chanQueue   chan T
     closed      chan struct{}
+    limiter     IRateLimiter
+    priority    func(T) int
+    ctx         context.Context
+    cancel      context.CancelFunc
+}
+
+type Producer = ProducerOf[interface{}]
+
+type producerOptionsOf[T any] struct {
+    limiter     IRateLimiter
+    priority    func(T) int
+}
+
+// ProducerOptionOf is an option of a ProducerOf[T], like ConsumerOptionOf.
+type ProducerOptionOf[T any] func(*producerOptionsOf[T])
+
+type ProducerOption = ProducerOptionOf[interface{}]
+
+// WithProducerRateLimitOf makes every item wait for limiter before it is
+// put to the queue. Once stopping the items left are put without waiting.
+func WithProducerRateLimitOf[T any](limiter IRateLimiter) ProducerOptionOf[T] {
+    return func(o *producerOptionsOf[T]) {
+        o.limiter = limiter
+    }
 }
 
+// WithPriorityFuncOf puts every item with the priority priority gives it
+// when the queue is an IWorkerQueuePriorityProducerOf, like a
+// PriorityQueueOf.
+func WithPriorityFuncOf[T any](priority func(T) int) ProducerOptionOf[T] {
+    return func(o *producerOptionsOf[T]) {
+        o.priority = priority
+    }
+}
+
+// WithProducerRateLimit is WithProducerRateLimitOf for the untyped API.
+func WithProducerRateLimit(limiter IRateLimiter) ProducerOption {
+    return WithProducerRateLimitOf[interface{}](limiter)
+}
+
+// WithPriorityFunc is WithPriorityFuncOf for the untyped API.
+func WithPriorityFunc(priority func(interface{}) int) ProducerOption {
+    return WithPriorityFuncOf[interface{}](priority)
+}
 
-func NewProducer(handler IProducerHandler) *Producer {
-    producer := &Producer{
+
+func NewProducer(handler IProducerHandler, opts ...ProducerOption) *Producer {
+    return NewProducerOf[interface{}](handler, opts...)
+}
+
+func NewProducerOf[T any](handler IProducerHandlerOf[T], opts ...ProducerOptionOf[T]) *ProducerOf[T] {
+    options := producerOptionsOf[T]{}
+
+    for _, opt := range opts {
+        opt(&options)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+
+    producer := &ProducerOf[T]{
         handler:    handler,
-        chanQueue:  make(chan interface{}),
+        chanQueue:  make(chan T),
         closed:     make(chan struct{}),
+        limiter:    options.limiter,
+        priority:   options.priority,
+        ctx:        ctx,
+        cancel:     cancel,
     }
     return producer
 }
 
 
-func (p *Producer) StartProducing(queue IWorkerQueueProducer) {
+func (p *ProducerOf[T]) bindContext(ctx context.Context) {
+    if binder, ok := p.handler.(contextBinder); ok {
+        binder.bindContext(ctx)
+    }
+}
+
+func (p *ProducerOf[T]) StartProducing(queue IWorkerQueueProducerOf[T]) {
     defer close(p.closed)
 
+    put := queue.Put
+
+    if priorityQueue, ok := queue.(IWorkerQueuePriorityProducerOf[T]); ok && p.priority != nil {
+        put = func(item T) {
+            priorityQueue.PutPriority(item, p.priority(item))
+        }
+    }
+
     go p.handler.Enqueue(p.chanQueue)
 
     for {
@@ -41,13 +123,17 @@ func (p *Producer) StartProducing(queue IWorkerQueueProducer) {
             if !ok {
                 return
             }
-            queue.Put(item)
+            if p.limiter != nil {
+                p.limiter.Wait(p.ctx)
+            }
+            put(item)
         }
     }
 }
 
 
-func (p *Producer) StopProducing() {
+func (p *ProducerOf[T]) StopProducing() {
+    p.cancel()
     p.handler.Stop()
     close(p.chanQueue)
     <- p.closed
@@ -59,29 +145,63 @@ func (p *Producer) StopProducing() {
 
 var _ IProducerHandler = (*IntervalProducerHandler)(nil)
 
-type IntervalProducerHandler struct {
-    fetch       func() []interface{}
+// IntervalProducerHandlerOf fetches items every interval. The context given
+// to fetch is cancelled by Stop and, inside a Worker, when the worker stops.
+type IntervalProducerHandlerOf[T any] struct {
+    fetch       func(context.Context) []T
     interval    time.Duration
     clock       txUtils.IClock
     enqueueNow  bool
+    ctx         context.Context
+    cancel      context.CancelFunc
     stop        chan struct{}
     stopWait    chan struct{}
 }
 
 
+type IntervalProducerHandler = IntervalProducerHandlerOf[interface{}]
+
+
 func NewIntervalProducerHandler(fetch func() []interface{}, interval time.Duration, enqueueNow bool) *IntervalProducerHandler {
-    handler := &IntervalProducerHandler{
+    return NewIntervalProducerHandlerOf[interface{}](fetch, interval, enqueueNow)
+}
+
+// NewContextIntervalProducerHandler is NewContextIntervalProducerHandlerOf
+// for the untyped API.
+func NewContextIntervalProducerHandler(fetch func(context.Context) []interface{}, interval time.Duration, enqueueNow bool) *IntervalProducerHandler {
+    return NewContextIntervalProducerHandlerOf[interface{}](fetch, interval, enqueueNow)
+}
+
+func NewIntervalProducerHandlerOf[T any](fetch func() []T, interval time.Duration, enqueueNow bool) *IntervalProducerHandlerOf[T] {
+    return NewContextIntervalProducerHandlerOf[T](func(ctx context.Context) []T {
+        return fetch()
+    }, interval, enqueueNow)
+}
+
+// NewContextIntervalProducerHandlerOf takes a fetch which should give up
+// when its context is done.
+func NewContextIntervalProducerHandlerOf[T any](fetch func(context.Context) []T, interval time.Duration, enqueueNow bool) *IntervalProducerHandlerOf[T] {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    handler := &IntervalProducerHandlerOf[T]{
         fetch:      fetch,
         interval:   interval,
         clock:      txUtils.NewRealClock(),
         enqueueNow: enqueueNow,
+        ctx:        ctx,
+        cancel:     cancel,
         stop:       make(chan struct{}),
         stopWait:   make(chan struct{}),
     }
     return handler
 }
 
-func (self *IntervalProducerHandler) Enqueue(chanQueue chan <- interface{}) {
+func (self *IntervalProducerHandlerOf[T]) bindContext(ctx context.Context) {
+    self.cancel()
+    self.ctx, self.cancel = context.WithCancel(ctx)
+}
+
+func (self *IntervalProducerHandlerOf[T]) Enqueue(chanQueue chan <- T) {
     if self.enqueueNow {
         self.fetchAndEnqueue(chanQueue)
         self.enqueueNow = false
@@ -90,14 +210,14 @@ func (self *IntervalProducerHandler) Enqueue(chanQueue chan <- interface{}) {
     self.enqueueLoop(chanQueue)
 }
 
-func (self *IntervalProducerHandler) fetchAndEnqueue(chanQueue chan <- interface{}) {
-    items := self.fetch()
+func (self *IntervalProducerHandlerOf[T]) fetchAndEnqueue(chanQueue chan <- T) {
+    items := self.fetch(self.ctx)
     for _, item := range items {
         chanQueue <- item
     }
 }
 
-func (self *IntervalProducerHandler) enqueueLoop(chanQueue chan <- interface{}) {
+func (self *IntervalProducerHandlerOf[T]) enqueueLoop(chanQueue chan <- T) {
     defer close(self.stopWait)
 
     intervalTimer := self.clock.Timer(self.interval)
@@ -114,7 +234,8 @@ func (self *IntervalProducerHandler) enqueueLoop(chanQueue chan <- interface{})
     }
 }
 
-func (self *IntervalProducerHandler) Stop() {
+func (self *IntervalProducerHandlerOf[T]) Stop() {
+    self.cancel()
     close(self.stop)
     <- self.stopWait
     self.fetch = nil
@@ -2,6 +2,7 @@ package worker
 
 import (
     "time"
+    "context"
     "testing"
     "github.com/stretchr/testify/assert"
     txUtils "github.com/serenity-77/bagudung/utils"
@@ -278,3 +279,50 @@ func TestIntervalProducerHandlerStopWhileFetch(t *testing.T) {
     assert.True(t, intervalTimer.Stopped())
     assertIntervalProducerHandlerStop(t, handler)
 }
+
+func TestIntervalProducerHandlerStopCancelsFetch(t *testing.T) {
+    chanQueue := make(chan interface{}, 3)
+    fetchReady := make(chan struct{})
+
+    fetch := func(ctx context.Context) []interface{} {
+        close(fetchReady)
+        <- ctx.Done()
+        return []interface{}{1}
+    }
+
+    handler := NewContextIntervalProducerHandler(fetch, 3 * time.Second, true)
+
+    go handler.Enqueue(chanQueue)
+
+    <- fetchReady
+
+    // the cancelled fetch returns and its items are still enqueued
+    handler.Stop()
+
+    assert.Equal(t, 1, <- chanQueue)
+    assertIntervalProducerHandlerStop(t, handler)
+}
+
+func TestProducerRateLimit(t *testing.T) {
+    clock := txUtils.NewFakeClock()
+    queue := NewQueue()
+
+    handler := NewIntervalProducerHandler(func() []interface{} {
+        return []interface{}{1, 2}
+    }, time.Hour, true)
+
+    producer := NewProducer(handler, WithProducerRateLimit(NewRateLimiter(1, time.Second, 1, clock)))
+
+    go producer.StartProducing(queue)
+
+    assert.Equal(t, 1, <- queue.Get())
+
+    // 2 waits for the limiter, the handler for its interval
+    clock.WaitUntilBlock(1)
+    assert.Equal(t, 0, queue.Pending())
+
+    clock.Advance(time.Second)
+    assert.Equal(t, 2, <- queue.Get())
+
+    producer.StopProducing()
+}
@@ -1,26 +1,92 @@
 package worker
 
 
-type Queue struct {
-    queue       chan interface{}
-    pending     []interface{}
-    waiting     chan interface{}
+import (
+    "errors"
+    "context"
+    "sync/atomic"
+)
+
+
+var _ IWorkerQueue = (*Queue)(nil)
+
+var (
+    ErrQueueFull    = errors.New("worker: queue is full")
+    ErrQueueClosed  = errors.New("worker: queue is closed")
+)
+
+// OverflowPolicy tells what Put does when a bounded queue is full.
+type OverflowPolicy int
+
+const (
+    // OverflowBlock blocks Put until a consumer takes an item.
+    OverflowBlock OverflowPolicy = iota
+    // OverflowDropNewest drops the item being put.
+    OverflowDropNewest
+    // OverflowDropOldest drops the oldest pending item to make room.
+    OverflowDropOldest
+)
+
+// QueueOf is an unbounded FIFO queue of T unless WithCapacity is given.
+type QueueOf[T any] struct {
+    queue       chan T
+    pending     []T
+    waiting     chan T
     lchan       chan int
+    tryChan     chan tryPut[T]
     putWaiter   chan struct{}
     closeChan   chan struct{}
+    capacity    int
+    overflow    OverflowPolicy
+    dropped     uint64
+}
+
+// Queue is the QueueOf interface{} the untyped worker API uses.
+type Queue = QueueOf[interface{}]
+
+type tryPut[T any] struct {
+    data    T
+    result  chan error
+}
+
+type queueOptions struct {
+    capacity    int
+    overflow    OverflowPolicy
 }
 
-func NewQueue() *Queue {
-    q := &Queue{}
-    q.queue = make(chan interface{})
-    q.waiting = make(chan interface{})
+type QueueOption func(*queueOptions)
+
+// WithCapacity bounds the pending items to capacity, overflow tells what
+// happens to the items put beyond.
+func WithCapacity(capacity int, overflow OverflowPolicy) QueueOption {
+    return func(o *queueOptions) {
+        o.capacity = capacity
+        o.overflow = overflow
+    }
+}
+
+func NewQueue(opts ...QueueOption) *Queue {
+    return NewQueueOf[interface{}](opts...)
+}
+
+func NewQueueOf[T any](opts ...QueueOption) *QueueOf[T] {
+    options := queueOptions{}
+    for _, opt := range opts {
+        opt(&options)
+    }
+    q := &QueueOf[T]{}
+    q.queue = make(chan T)
+    q.waiting = make(chan T)
     q.lchan = make(chan int)
+    q.tryChan = make(chan tryPut[T])
     q.closeChan = make(chan struct{})
+    q.capacity = options.capacity
+    q.overflow = options.overflow
     go q._queueLoop()
     return q
 }
 
-func (q *Queue) _queueLoop() {
+func (q *QueueOf[T]) _queueLoop() {
     // make sure queue loop goroutine is stopped
     // so that no race can occurs.
     defer close(q.closeChan)
@@ -35,6 +101,8 @@ Loop:
         } else {
             select {
             case q.lchan <- len(q.pending):
+            case req := <- q.tryChan:
+                q._tryPut(req)
             case data, ok := <- q.queue:
                 if !ok {
                     break Loop
@@ -51,15 +119,43 @@ Loop:
     q._finishPending()
 }
 
-func (q *Queue) Put(data interface{}) {
+func (q *QueueOf[T]) Put(data T) {
     q.queue <- data
 }
 
-func (q *Queue) Get() <- chan interface{} {
+// putContext is Put giving up when ctx is done, like when a bounded queue
+// stays full.
+func (q *QueueOf[T]) putContext(ctx context.Context, data T) error {
+    select {
+    case q.queue <- data:
+        return nil
+    case <- ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// TryPut puts data unless the queue is full, whatever the overflow policy.
+func (q *QueueOf[T]) TryPut(data T) error {
+    req := tryPut[T]{data, make(chan error, 1)}
+
+    select {
+    case q.tryChan <- req:
+        return <- req.result
+    case <- q.closeChan:
+        return ErrQueueClosed
+    }
+}
+
+// Dropped returns the number of items dropped by the overflow policy.
+func (q *QueueOf[T]) Dropped() uint64 {
+    return atomic.LoadUint64(&q.dropped)
+}
+
+func (q *QueueOf[T]) Get() <- chan T {
     return q.waiting
 }
 
-func (q *Queue) Pending() int {
+func (q *QueueOf[T]) Pending() int {
     select {
     case <- q.closeChan:
         return len(q.pending)
@@ -68,35 +164,73 @@ func (q *Queue) Pending() int {
     }
 }
 
-func (q *Queue) Close() {
+func (q *QueueOf[T]) Close() {
     close(q.queue)
     <- q.closeChan
 }
 
-func (q *Queue) addPending(data interface{}) {
+func (q *QueueOf[T]) addPending(data T) {
     q.pending = append(q.pending, data)
 }
 
-func (q *Queue) _processPending() bool {
+func (q *QueueOf[T]) full() bool {
+    return q.capacity > 0 && len(q.pending) >= q.capacity
+}
+
+// _put adds data to the pending items, applying the overflow policy.
+func (q *QueueOf[T]) _put(data T) {
+    if q.full() {
+        atomic.AddUint64(&q.dropped, 1)
+        if q.overflow == OverflowDropNewest {
+            return
+        }
+        var zero T
+        q.pending[0] = zero
+        q.pending = q.pending[1:]
+    }
+    q.addPending(data)
+}
+
+func (q *QueueOf[T]) _tryPut(req tryPut[T]) {
+    if q.full() {
+        req.result <- ErrQueueFull
+        return
+    }
+    q.addPending(req.data)
+    req.result <- nil
+}
+
+func (q *QueueOf[T]) _processPending() bool {
+    queue := q.queue
+
+    // leave Put blocked until there is room
+    if q.overflow == OverflowBlock && q.full() {
+        queue = nil
+    }
+
     select {
     case q.lchan <- len(q.pending):
-    case data, ok := <- q.queue:
+    case req := <- q.tryChan:
+        q._tryPut(req)
+    case data, ok := <- queue:
         if !ok {
             return false
         }
-        q.addPending(data)
+        q._put(data)
     case q.waiting <- q.pending[0]:
         q.pending = q.pending[1:]
     }
     return true
 }
 
-func (q *Queue) _finishPending() {
+func (q *QueueOf[T]) _finishPending() {
     for len(q.pending) > 0 {
         select {
         case q.waiting <- q.pending[0]:
             q.pending = q.pending[1:]
         case q.lchan <- len(q.pending):
+        case req := <- q.tryChan:
+            req.result <- ErrQueueClosed
         }
     }
 }
@@ -2,6 +2,7 @@ package worker
 
 import (
     "sync"
+    "time"
     "testing"
     "github.com/stretchr/testify/assert"
 )
@@ -144,3 +145,78 @@ func TestQueueCloseEmpty(t *testing.T) {
         assert.Fail(t, "Queue Not Closed")
     }
 }
+
+func TestQueueCapacityBlock(t *testing.T) {
+    q := NewQueue(WithCapacity(2, OverflowBlock))
+
+    q.Put(1)
+    q.Put(2)
+
+    put := make(chan struct{})
+
+    go func() {
+        q.Put(3)
+        close(put)
+    }()
+
+    select {
+    case <- put:
+        assert.Fail(t, "Put Not Blocked")
+    case <- time.After(20 * time.Millisecond):
+    }
+
+    assert.Equal(t, 2, q.Pending())
+    assert.Equal(t, ErrQueueFull, q.TryPut(4))
+
+    assert.Equal(t, 1, <- q.Get())
+    <- put
+
+    assert.Equal(t, 2, <- q.Get())
+    assert.Equal(t, 3, <- q.Get())
+    assert.Equal(t, uint64(0), q.Dropped())
+
+    q.Close()
+    assert.Equal(t, ErrQueueClosed, q.TryPut(5))
+}
+
+func TestQueueCapacityDrop(t *testing.T) {
+    cases := []struct {
+        overflow    OverflowPolicy
+        expected    []interface{}
+    }{
+        {OverflowDropNewest, []interface{}{1, 2}},
+        {OverflowDropOldest, []interface{}{3, 4}},
+    }
+
+    for _, c := range cases {
+        q := NewQueue(WithCapacity(2, c.overflow))
+
+        for i := 1; i <= 4; i++ {
+            q.Put(i)
+        }
+
+        assert.Equal(t, 2, q.Pending())
+        assert.Equal(t, uint64(2), q.Dropped())
+        assert.Equal(t, ErrQueueFull, q.TryPut(5))
+        assert.Equal(t, c.expected, []interface{}{<- q.Get(), <- q.Get()})
+
+        assert.Nil(t, q.TryPut(6))
+        assert.Equal(t, 6, <- q.Get())
+
+        q.Close()
+    }
+}
+
+func TestQueueOf(t *testing.T) {
+    q := NewQueueOf[string](WithCapacity(1, OverflowDropOldest))
+
+    q.Put("a")
+    q.Put("b")
+
+    var value string = <- q.Get()
+
+    assert.Equal(t, "b", value)
+    assert.Equal(t, uint64(1), q.Dropped())
+
+    q.Close()
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+    "fmt"
+    "math"
+    "time"
+)
+
+
+var _ RetryPolicy = (*ConstantRetryPolicy)(nil)
+var _ RetryPolicy = (*ExponentialRetryPolicy)(nil)
+
+// RetryPolicy decides how long a Consumer waits before handling an item
+// again after its attempt-th failure, attempts start at 1. Returning false
+// gives the item up.
+type RetryPolicy interface {
+    NextDelay(attempt int) (time.Duration, bool)
+}
+
+// PanicError is the error of a handler which panicked.
+type PanicError struct {
+    Value   interface{}
+    Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+    return fmt.Sprintf("worker: handler panic: %v", e.Value)
+}
+
+
+// ConstantRetryPolicy waits delay between at most maxAttempts attempts,
+// the first one included.
+type ConstantRetryPolicy struct {
+    delay       time.Duration
+    maxAttempts int
+}
+
+func NewConstantRetryPolicy(delay time.Duration, maxAttempts int) *ConstantRetryPolicy {
+    return &ConstantRetryPolicy{delay, maxAttempts}
+}
+
+func (p *ConstantRetryPolicy) NextDelay(attempt int) (time.Duration, bool) {
+    return p.delay, attempt < p.maxAttempts
+}
+
+
+// ExponentialRetryPolicy multiplies the delay by multiplier after every
+// failure up to max, for at most maxAttempts attempts. A max of zero does
+// not cap the delay, like with the client's ExponentialReconnectPolicy.
+type ExponentialRetryPolicy struct {
+    initial     time.Duration
+    max         time.Duration
+    multiplier  float64
+    maxAttempts int
+}
+
+// NewExponentialRetryPolicy starts at a second when initial is not
+// positive.
+func NewExponentialRetryPolicy(initial, max time.Duration, multiplier float64, maxAttempts int) *ExponentialRetryPolicy {
+    if initial <= 0 {
+        initial = time.Second
+    }
+
+    if multiplier < 1 {
+        multiplier = 1
+    }
+
+    return &ExponentialRetryPolicy{
+        initial:        initial,
+        max:            max,
+        multiplier:     multiplier,
+        maxAttempts:    maxAttempts,
+    }
+}
+
+func (p *ExponentialRetryPolicy) NextDelay(attempt int) (time.Duration, bool) {
+    if attempt >= p.maxAttempts {
+        return 0, false
+    }
+
+    limit := float64(p.max)
+
+    if p.max <= 0 {
+        limit = float64(math.MaxInt64 / 2)
+    }
+
+    delay := float64(p.initial)
+
+    for i := 1; i < attempt && delay < limit; i++ {
+        delay *= p.multiplier
+    }
+
+    if delay > limit {
+        delay = limit
+    }
+
+    return time.Duration(delay), true
+}
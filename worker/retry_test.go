@@ -0,0 +1,54 @@
+package worker
+
+import (
+    "time"
+    "testing"
+    "github.com/stretchr/testify/assert"
+)
+
+
+func TestConstantRetryPolicy(t *testing.T) {
+    policy := NewConstantRetryPolicy(time.Second, 3)
+
+    for attempt := 1; attempt <= 2; attempt++ {
+        delay, ok := policy.NextDelay(attempt)
+        assert.True(t, ok)
+        assert.Equal(t, time.Second, delay)
+    }
+
+    _, ok := policy.NextDelay(3)
+    assert.False(t, ok)
+}
+
+func TestExponentialRetryPolicy(t *testing.T) {
+    policy := NewExponentialRetryPolicy(time.Second, 5 * time.Second, 2, 5)
+
+    delays := []time.Duration{}
+
+    for attempt := 1; ; attempt++ {
+        delay, ok := policy.NextDelay(attempt)
+        if !ok {
+            break
+        }
+        delays = append(delays, delay)
+    }
+
+    assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, delays)
+}
+
+func TestExponentialRetryPolicyNoMax(t *testing.T) {
+    policy := NewExponentialRetryPolicy(time.Second, 0, 2, 5)
+
+    delay, _ := policy.NextDelay(4)
+    assert.Equal(t, 8 * time.Second, delay)
+
+    policy = NewExponentialRetryPolicy(0, time.Minute, 2, 5)
+
+    delay, _ = policy.NextDelay(1)
+    assert.Equal(t, time.Second, delay)
+}
+
+func TestPanicError(t *testing.T) {
+    err := &PanicError{Value: "boom"}
+    assert.Equal(t, "worker: handler panic: boom", err.Error())
+}
@@ -2,61 +2,232 @@ package worker
 
 
 import (
+    "context"
     "github.com/sirupsen/logrus"
 )
 
-type IWorkerProducer interface {
-    StartProducing(IWorkerQueueProducer)
+// The Of types are the typed worker API, the untyped names are kept as
+// their interface{} instances. Go does not allow a generic and a plain type
+// of the same name, hence the suffix.
+
+type IWorkerProducerOf[T any] interface {
+    StartProducing(IWorkerQueueProducerOf[T])
     StopProducing()
 }
 
-type IWorkerConsumer interface {
-    StartConsuming(IWorkerQueueConsumer)
+type IWorkerConsumerOf[T any] interface {
+    StartConsuming(IWorkerQueueConsumerOf[T])
     StopConsuming()
 }
 
 
-type IWorkerQueueProducer interface {
-    Put(interface{})
+// IWorkerConsumerAborterOf is implemented by consumers which can stop
+// before the queue is closed, see Worker.Shutdown.
+type IWorkerConsumerAborterOf[T any] interface {
+    AbortConsuming()    []T
+}
+
+type IWorkerQueueProducerOf[T any] interface {
+    Put(T)
+}
+
+type IWorkerQueueConsumerOf[T any] interface {
+    Get()   <- chan T
+}
+
+// IWorkerQueuePriorityProducerOf is implemented by queues which take the
+// items with a priority, like PriorityQueueOf.
+type IWorkerQueuePriorityProducerOf[T any] interface {
+    IWorkerQueueProducerOf[T]
+    PutPriority(T, int)
 }
 
-type IWorkerQueueConsumer interface {
-    Get()   <- chan interface{}
+// IWorkerQueueOf is the queue between the producer and the consumer of a
+// Worker, Close closes the Get channel once the pending items are taken.
+type IWorkerQueueOf[T any] interface {
+    IWorkerQueueProducerOf[T]
+    IWorkerQueueConsumerOf[T]
+    Pending()   int
+    Close()
 }
 
-type Worker struct {
-    queue       *Queue
-    producer    IWorkerProducer
-    consumer    IWorkerConsumer
+type IWorkerProducer = IWorkerProducerOf[interface{}]
+type IWorkerConsumer = IWorkerConsumerOf[interface{}]
+type IWorkerQueueProducer = IWorkerQueueProducerOf[interface{}]
+type IWorkerQueueConsumer = IWorkerQueueConsumerOf[interface{}]
+type IWorkerQueue = IWorkerQueueOf[interface{}]
+type IWorkerQueuePriorityProducer = IWorkerQueuePriorityProducerOf[interface{}]
+type IWorkerConsumerAborter = IWorkerConsumerAborterOf[interface{}]
+
+// ShutdownMode tells Worker.Shutdown what to do with the pending items.
+type ShutdownMode int
+
+const (
+    // ShutdownDrain handles the pending items until the context is done
+    // and aborts then.
+    ShutdownDrain ShutdownMode = iota
+    // ShutdownAbort cancels the handlers and returns the pending items.
+    ShutdownAbort
+)
+
+type WorkerOf[T any] struct {
+    queue       IWorkerQueueOf[T]
+    producer    IWorkerProducerOf[T]
+    consumer    IWorkerConsumerOf[T]
     logger      *logrus.Logger
+    ctx         context.Context
+    cancel      context.CancelFunc
 }
 
+type Worker = WorkerOf[interface{}]
+
 func NewWorker(producer IWorkerProducer, consumer IWorkerConsumer) *Worker {
-    worker := &Worker{
-        queue:      NewQueue(),
+    return NewWorkerOf[interface{}](producer, consumer)
+}
+
+// NewWorkerQueue is NewWorker with another queue, like a PriorityQueue.
+func NewWorkerQueue(queue IWorkerQueue, producer IWorkerProducer, consumer IWorkerConsumer) *Worker {
+    return NewWorkerQueueOf[interface{}](queue, producer, consumer)
+}
+
+// NewWorkerContext is NewWorkerContextOf for the untyped API.
+func NewWorkerContext(ctx context.Context, queue IWorkerQueue, producer IWorkerProducer, consumer IWorkerConsumer) *Worker {
+    return NewWorkerContextOf[interface{}](ctx, queue, producer, consumer)
+}
+
+func NewWorkerOf[T any](producer IWorkerProducerOf[T], consumer IWorkerConsumerOf[T]) *WorkerOf[T] {
+    return NewWorkerQueueOf[T](NewQueueOf[T](), producer, consumer)
+}
+
+func NewWorkerQueueOf[T any](queue IWorkerQueueOf[T], producer IWorkerProducerOf[T], consumer IWorkerConsumerOf[T]) *WorkerOf[T] {
+    return NewWorkerContextOf[T](context.Background(), queue, producer, consumer)
+}
+
+// NewWorkerContextOf is NewWorkerQueueOf with a parent for the worker
+// context.
+func NewWorkerContextOf[T any](ctx context.Context, queue IWorkerQueueOf[T], producer IWorkerProducerOf[T], consumer IWorkerConsumerOf[T]) *WorkerOf[T] {
+    ctx, cancel := context.WithCancel(ctx)
+
+    worker := &WorkerOf[T]{
+        queue:      queue,
         producer:   producer,
         consumer:   consumer,
+        ctx:        ctx,
+        cancel:     cancel,
     }
 
-    go worker.startConsumer()
-    go worker.startProducer()
+    for _, part := range []interface{}{queue, producer, consumer} {
+        if binder, ok := part.(contextBinder); ok {
+            binder.bindContext(ctx)
+        }
+    }
+
+    // Stop clears the fields, the goroutines must not read them
+    go consumer.StartConsuming(queue)
+    go producer.StartProducing(queue)
 
     return worker
 }
 
-func (w *Worker) Stop() {
-    w.producer.StopProducing()
-    w.queue.Close()
-    w.consumer.StopConsuming()
+// Context returns the worker context. The fetch of the producer and the
+// handlers of the consumer get a child of it, it is cancelled by an
+// aborting Shutdown and once Stop or a Shutdown drained.
+func (w *WorkerOf[T]) Context() context.Context {
+    return w.ctx
+}
+
+// Stop stops the producer, waits until the consumer handled the pending
+// items and cancels the worker context then. The items are dropped when the
+// parent cancelled the worker context, Shutdown returns them.
+func (w *WorkerOf[T]) Stop() {
+    w.Shutdown(context.Background(), ShutdownDrain)
+}
+
+// Shutdown stops the producer and closes the queue like Stop. On abort the
+// consumer is aborted and the items it gave up are returned with the items
+// left in the queue, in that order, so they can be stored or requeued. A
+// drain which hits the context, or finds the worker context cancelled by
+// its parent, aborts and returns the error of that context. Consumers which
+// do not implement IWorkerConsumerAborterOf are always drained.
+//
+// Shutdown returns once ctx is done in any case, with the error of ctx and
+// the items collected by then. A handler which does not give up on its
+// context is left running then and its item is lost, as is the goroutine
+// waiting for it.
+func (w *WorkerOf[T]) Shutdown(ctx context.Context, mode ShutdownMode) ([]T, error) {
+    producer, queue, consumer := w.producer, w.queue, w.consumer
+
     w.producer = nil
     w.consumer = nil
     w.queue = nil
-}
 
-func (w *Worker) startConsumer() {
-    w.consumer.StartConsuming(w.queue)
-}
+    stopped := make(chan struct{})
+
+    go func() {
+        producer.StopProducing()
+        queue.Close()
+        consumer.StopConsuming()
+        close(stopped)
+    }()
+
+    var err error
+
+    if mode == ShutdownDrain {
+        select {
+        case <- stopped:
+            w.cancel()
+            return nil, nil
+        case <- ctx.Done():
+            err = ctx.Err()
+        case <- w.ctx.Done():
+            // the consumer does not take the items left any more
+            err = w.ctx.Err()
+        }
+    }
+
+    // the handlers of the consumer are cancelled with the worker context
+    w.cancel()
+
+    aborter, ok := consumer.(IWorkerConsumerAborterOf[T])
+
+    if !ok {
+        select {
+        case <- stopped:
+            return nil, err
+        case <- ctx.Done():
+            return nil, ctx.Err()
+        }
+    }
+
+    abortWait := make(chan []T, 1)
+
+    go func() {
+        abortWait <- aborter.AbortConsuming()
+    }()
+
+    var aborted, pending []T
+
+    // nobody takes the items now, the queue is closed once the producer
+    // is stopped
+    pendingItems := queue.Get()
+    stopWait := stopped
+
+    for abortWait != nil || pendingItems != nil || stopWait != nil {
+        select {
+        case aborted = <- abortWait:
+            abortWait = nil
+        case item, ok := <- pendingItems:
+            if !ok {
+                pendingItems = nil
+                continue
+            }
+            pending = append(pending, item)
+        case <- stopWait:
+            stopWait = nil
+        case <- ctx.Done():
+            return append(aborted, pending...), ctx.Err()
+        }
+    }
 
-func (w *Worker) startProducer() {
-    w.producer.StartProducing(w.queue)
+    return append(aborted, pending...), err
 }
@@ -2,6 +2,8 @@ package worker
 
 
 import (
+    "time"
+    "context"
     "testing"
     "github.com/stretchr/testify/assert"
 )
@@ -119,7 +121,7 @@ func TestWorkerStop(t *testing.T) {
     <- producer.started
     <- consumer.started
 
-    queue := worker.queue
+    queue := worker.queue.(*Queue)
 
     assert.NotNil(t, worker)
 
@@ -132,3 +134,208 @@ func TestWorkerStop(t *testing.T) {
     assert.True(t, producer.stopped)
     assert.True(t, consumer.stopped)
 }
+
+func TestWorkerStopDrains(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2, 3, 4, 5}, make(chan struct{})}
+    release := make(chan struct{})
+    handled := make(chan interface{}, 5)
+
+    consumer := NewConsumer(func(data interface{}) {
+        <- release
+        handled <- data
+    }, 1)
+
+    worker := NewWorker(producer, consumer)
+    ctx := worker.Context()
+
+    <- producer.put
+    close(release)
+
+    worker.Stop()
+
+    assert.Equal(t, 5, len(handled))
+    assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+type testJob struct {
+    id      int
+    name    string
+}
+
+func TestWorkerOf(t *testing.T) {
+    handler := NewIntervalProducerHandlerOf[testJob](func() []testJob {
+        return []testJob{{1, "one"}, {2, "two"}}
+    }, time.Hour, true)
+
+    handled := make(chan testJob, 2)
+
+    consumer := NewConsumerOf[testJob](func(job testJob) {
+        handled <- job
+    }, 1)
+
+    worker := NewWorkerOf[testJob](NewProducerOf[testJob](handler), consumer)
+
+    assert.Equal(t, testJob{1, "one"}, <- handled)
+    assert.Equal(t, testJob{2, "two"}, <- handled)
+
+    worker.Stop()
+}
+
+// sliceProducer puts its items once and signals put.
+type sliceProducer struct {
+    items   []interface{}
+    put     chan struct{}
+}
+
+func (sp *sliceProducer) StartProducing(queue IWorkerQueueProducer) {
+    for _, item := range sp.items {
+        queue.Put(item)
+    }
+    close(sp.put)
+}
+
+func (sp *sliceProducer) StopProducing() {}
+
+func TestWorkerShutdownDrain(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2, 3}, make(chan struct{})}
+    handled := make(chan interface{}, 3)
+
+    consumer := NewConsumer(func(data interface{}) {
+        handled <- data
+    }, 1)
+
+    worker := NewWorker(producer, consumer)
+
+    <- producer.put
+
+    items, err := worker.Shutdown(context.Background(), ShutdownDrain)
+
+    assert.Nil(t, err)
+    assert.Nil(t, items)
+    assert.Equal(t, 3, len(handled))
+    assert.Nil(t, worker.queue)
+}
+
+func blockingConsumer(started chan interface{}) *Consumer {
+    return NewContextConsumerOf[interface{}](func(ctx context.Context, data interface{}) error {
+        started <- data
+        <- ctx.Done()
+        return ctx.Err()
+    }, 1, nil, nil)
+}
+
+func TestWorkerShutdownAbort(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2, 3}, make(chan struct{})}
+    started := make(chan interface{}, 3)
+
+    worker := NewWorker(producer, blockingConsumer(started))
+
+    <- producer.put
+    assert.Equal(t, 1, <- started)
+
+    items, err := worker.Shutdown(context.Background(), ShutdownAbort)
+
+    assert.Nil(t, err)
+    assert.Equal(t, []interface{}{1, 2, 3}, items)
+}
+
+func TestWorkerShutdownDrainDeadline(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2}, make(chan struct{})}
+    started := make(chan interface{}, 2)
+
+    worker := NewWorker(producer, blockingConsumer(started))
+
+    <- producer.put
+    <- started
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+
+    items, err := worker.Shutdown(ctx, ShutdownDrain)
+
+    // the deadline has passed, only the items at hand are returned
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.Subset(t, []interface{}{1, 2}, items)
+}
+
+func TestWorkerShutdownStuckHandler(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2, 3}, make(chan struct{})}
+    started := make(chan interface{}, 3)
+    release := make(chan struct{})
+
+    consumer := NewContextConsumer(func(ctx context.Context, data interface{}) error {
+        started <- data
+        <- release
+        return nil
+    }, 1, nil, nil)
+
+    worker := NewWorker(producer, consumer)
+
+    <- producer.put
+    assert.Equal(t, 1, <- started)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+
+    // 1 is held by the handler ignoring its context
+    items, err := worker.Shutdown(ctx, ShutdownAbort)
+
+    assert.Equal(t, context.DeadlineExceeded, err)
+    assert.Equal(t, []interface{}{2, 3}, items)
+
+    close(release)
+}
+
+func TestWorkerContext(t *testing.T) {
+    fetched := make(chan struct{})
+    cancelled := make(chan struct{})
+
+    producer := NewProducer(NewContextIntervalProducerHandler(func(ctx context.Context) []interface{} {
+        close(fetched)
+        <- ctx.Done()
+        close(cancelled)
+        return nil
+    }, time.Hour, true))
+
+    consumer := &dummyConsumer{started: make(chan struct{}, 1)}
+
+    parent, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    worker := NewWorkerContext(parent, NewQueue(), producer, consumer)
+    ctx := worker.Context()
+
+    <- fetched
+    assert.Nil(t, ctx.Err())
+
+    worker.Stop()
+
+    <- cancelled
+    assert.Equal(t, context.Canceled, ctx.Err())
+
+    // the worker context is a child of the parent
+    consumer = &dummyConsumer{started: make(chan struct{}, 1)}
+    worker = NewWorkerContext(parent, NewQueue(), &dummyProducer{started: make(chan struct{}, 1)}, consumer)
+    cancel()
+    <- worker.Context().Done()
+    worker.Stop()
+}
+
+func TestWorkerContextHandlers(t *testing.T) {
+    producer := &sliceProducer{[]interface{}{1, 2}, make(chan struct{})}
+    started := make(chan interface{}, 2)
+
+    parent, cancel := context.WithCancel(context.Background())
+
+    worker := NewWorkerContext(parent, NewQueue(), producer, blockingConsumer(started))
+
+    <- producer.put
+    assert.Equal(t, 1, <- started)
+
+    // the handler gives up with the parent, 2 is not handled after it
+    cancel()
+    <- worker.Context().Done()
+
+    worker.Stop()
+    assert.Equal(t, 0, len(started))
+}